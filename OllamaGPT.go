@@ -13,17 +13,39 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/segmentio/encoding/json"
 )
 
-var debug = true // only change if testing or if you like console logs for whatever reason
+var debug = true // only change if testing or if you like console logs for whatever reason (OLLAMAGPT_DEBUG or -debug override it without rebuilding)
 
 // Global stream override: nil = per-request, true = always stream, false = never stream
 var streamOverride *bool
@@ -31,9 +53,503 @@ var streamOverride *bool
 // Global dementia mode override: nil = ask user, true = always enable, false = always disable (just don't touch if u don't know what you're doing)
 var dementiaOverride *bool
 
+// config holds every tunable that can be set from the command line (see bindFlags)
+type config struct {
+	ConfigFile        string        // json file with flag values (command line flags win over it)
+	Listen            string        // address the server listens on (needs a restart to change)
+	Upstream          string        // base url every request gets forwarded to
+	Upstreams         string        // comma separated base urls tried in order when one is down (beats Upstream)
+	UpstreamHeader    stringList    // "Key: Value" headers sent on every upstream call (repeatable)
+	CORSOrigin        string        // comma separated origins browsers may call from, * for any
+	ExposeUpstreamMs  bool          // echo the upstream reported ms into the returned frame (off by default since it's not part of the ollama format)
+	OnOverlength      string        // what to do with prompts over the limit when dementia mode is off: block, trim or error
+	MaxReplyChars     int           // upstream replies longer than this get cut off with done_reason "length" (0 = no limit)
+	EmptyReply        string        // what the client sees when the upstream answers with an empty reply (empty = pass it on)
+	MaxMessages       int           // requests with more messages than this are refused before any trimming (0 = no limit)
+	LogTiming         bool          // log a parse/upstream/stream timing breakdown for every request
+	InstantFirstChunk bool          // skip the inter chunk delay for the first chunk only
+	ChunkDelay        time.Duration // pause before every streamed chunk (some slow web clients choke without it)
+	ChunkSize         int           // characters per streamed chunk (whole words, so chunks can run a bit over)
+	ForwardOptions    string        // comma separated option keys passed through to the v2 endpoint
+	DisableModels     string        // comma separated models to switch off everywhere (tags, routing)
+	Retries           int           // how many times a failed upstream call gets retried (0 = never)
+	RetryDelay        time.Duration // delay before the first retry (doubles every retry)
+	RetryOn           string        // comma separated failure classes that get retried (see retryClasses)
+	MaxDownloadSize   int64         // biggest generated file (image/audio) the proxy will download itself
+	Base64Format      string        // how base64 model output reaches the client: markdown, images or raw
+	RevisedPrompt     bool          // put dall-e's revised_prompt on a line before each image url
+	NoContentLogs     bool          // never log prompt/reply text, only metadata
+	NoPrewarm         bool          // skip the hello world request to the upstream at startup
+	SanitizeStream    bool          // strip newlines and other control characters from streamed replies
+	ReportUsage       bool          // add an openai style usage object to the final chat frame
+	IPRate            float64       // chat/generate requests per minute each client ip gets (0 = no limit)
+	IPBurst           int           // how many requests a client ip can fire at once before IPRate kicks in
+	IPLimitLocalhost  bool          // apply the per ip limit to loopback clients too
+	AdminToken        string        // bearer token for the /admin endpoints (empty = admin endpoints are off)
+	APIKey            string        // bearer token the endpoints that use upstream quota require (empty = open)
+	SystemPrompt      string        // house system message put in front of every chat/generate conversation
+	DefaultModel      string        // model used (and reported back) when a request leaves model empty
+	Alias             string        // comma separated name=target model aliases
+	TaskScope         string        // which messages get scanned for "### Task:" spam: latest or all
+	BlockTaskSpam     bool          // block "### Task:" requests (open webui titles/autocomplete/follow ups) at all
+	Stream            string        // on/off/ask skips the streaming question at startup (empty = ask on the console)
+	Dementia          string        // on/off skips the dementia mode question at startup (empty or ask = ask on the console)
+	Debug             optionalBool  // overrides the debug var (and OLLAMAGPT_DEBUG) when given
+	OllamaVersion     string        // version /api/version pretends to be
+	EmbeddingsURL     string        // openai style embeddings endpoint (empty = embeddings are off)
+	CharsPerToken     float64       // divisor for the rough token estimate dementia mode trims with (0 = count bytes)
+	StrictModels      bool          // answer unknown models with a 404 instead of quietly using gpt-3.5
+	ChatTimeout       time.Duration // per attempt limit for chat upstream calls (also embeddings and the prewarm)
+	ImageTimeout      time.Duration // per attempt limit for dall-e-3/base64 (image generation is slow)
+	TTSTimeout        time.Duration // per attempt limit for tts
+	ShutdownGrace     time.Duration // how long in flight requests get to finish on SIGINT/SIGTERM
+	LogFormat         string        // text or json (json is for shipping logs to loki and friends)
+	LogLevel          string        // lowest level that gets logged: debug, info, warn or error (empty = debug in debug mode, info otherwise)
+	MaxConcurrent     int           // requests allowed at the upstream at once (0 = no limit), restart only
+	QueueTimeout      time.Duration // how long a request waits for a free slot before getting "server busy"
+	Limits            string        // per category prompt length overrides like "gpt4=16000,tts=800" (see defaultLimits)
+	ModelsFile        string        // json file with the advertised model list (empty = defaultTagModels)
+	CacheTTL          time.Duration // how long identical chat requests get answered from memory (0 = no cache)
+	CacheSize         int           // most replies the cache holds before dropping the least recently used
+	TLSCert           string        // certificate file, serves https together with TLSKey (restart only)
+	TLSKey            string        // private key file for TLSCert
+
+	forwardOptions map[string]bool   // parsed ForwardOptions (filled in by validate)
+	disabledModels map[string]bool   // parsed DisableModels (filled in by validate)
+	retryOn        map[string]bool   // parsed RetryOn (filled in by validate)
+	limits         map[string]int    // defaultLimits + OLLAMAGPT_LIMITS + Limits (filled in by validate)
+	upstreams      []string          // parsed Upstreams, or just Upstream (filled in by validate)
+	corsOrigins    map[string]bool   // parsed CORSOrigin, "*" in it means any (filled in by validate)
+	aliases        map[string]string // parsed Alias, alias base name -> target base name (filled in by validate)
+	upstreamHeader http.Header       // parsed UpstreamHeader (filled in by validate)
+}
+
+// defaultLimits are the prompt length limits (characters) per model category: gpt4 is the gpt-4o/gpt-4.1 family,
+// default is gpt-3.5 (and every unknown model), image is dall-e-3/base64 and tts is tts
+var defaultLimits = map[string]int{
+	"gpt4":    8000,
+	"default": 2000,
+	"image":   1000,
+	"tts":     500,
+}
+
+// limitCategory maps a routed model (see modelRoute) to its -limits category
+func limitCategory(route string) string {
+	switch route {
+	case "gpt-4o", "gpt-4o-mini", "gpt-4.1-nano", "gpt-4.1-mini", "gpt-4.1":
+		return "gpt4"
+	case "dall-e-3", "base64":
+		return "image"
+	case "tts":
+		return "tts"
+	}
+	return "default"
+}
+
+// contextLength is the context size (in tokens) advertised for a routed model, the prompt limit divided by
+// -chars-per-token so clients trimming history to it stay under the length guards
+func contextLength(c *config, route string) int {
+	limits, charsPerToken := defaultLimits, 4.0
+	if c != nil && c.limits != nil {
+		limits = c.limits
+	}
+	if c != nil && c.CharsPerToken > 0 {
+		charsPerToken = c.CharsPerToken
+	}
+	return tokenBudget(limits[limitCategory(route)], charsPerToken)
+}
+
+// parseLimits layers the env json blob ({"gpt4": 16000}) and then the -limits list (gpt4=16000,tts=800) over defaultLimits
+func parseLimits(envJSON, list string) (map[string]int, error) {
+	limits := make(map[string]int, len(defaultLimits))
+	for k, v := range defaultLimits {
+		limits[k] = v
+	}
+	overrides := map[string]int{}
+	if strings.TrimSpace(envJSON) != "" {
+		if err := json.Unmarshal([]byte(envJSON), &overrides); err != nil {
+			return nil, fmt.Errorf("OLLAMAGPT_LIMITS: %w", err)
+		}
+	}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(item, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err != nil {
+			return nil, fmt.Errorf("-limits: %q should look like category=number", item)
+		}
+		overrides[strings.TrimSpace(k)] = n
+	}
+	for k, n := range overrides {
+		if _, ok := defaultLimits[k]; !ok {
+			return nil, fmt.Errorf("limits: unknown category %q (gpt4, default, image or tts)", k)
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("limits: %s must be positive", k)
+		}
+		limits[k] = n
+	}
+	return limits, nil
+}
+
+// upstreamTimeout picks the timeout for a routed model (see modelRoute)
+func (c *config) upstreamTimeout(route string) time.Duration {
+	switch route {
+	case "dall-e-3", "base64":
+		return c.ImageTimeout
+	case "tts":
+		return c.TTSTimeout
+	}
+	return c.ChatTimeout
+}
+
+// liveCfg is the config in use, swapped atomically when the config file gets reloaded (SIGHUP)
+var liveCfg atomic.Pointer[config]
+
+// conf returns the config in use (grab it once per request so a reload mid request can't mix old and new values)
+func conf() *config {
+	return liveCfg.Load()
+}
+
+// bindFlags registers all the flags onto c so adding a new tunable is just a field + one line here
+func (c *config) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", "", "json file of flag values keyed by flag name (flags given on the command line override it)")
+	fs.StringVar(&c.Listen, "listen", ":11434", "address to listen on (default is the ollama port)")
+	fs.StringVar(&c.Upstream, "upstream", "https://pfuner.xyz", "base url of the upstream api")
+	fs.StringVar(&c.CORSOrigin, "cors-origin", "*", "comma separated origins allowed to call the api from a browser (e.g. http://localhost:3000), * allows any")
+	fs.StringVar(&c.Upstreams, "upstreams", "", "comma separated upstream base urls, tried in order (last working one first) until one isn't down or cloudflare blocked. replaces -upstream")
+	fs.BoolVar(&c.ExposeUpstreamMs, "expose-upstream-ms", false, "add an upstream_ms field with the upstream reported latency to the final chat frame")
+	fs.StringVar(&c.OnOverlength, "on-overlength", "block", "what to do with over the limit prompts without dementia mode: block (apology message), trim (same as dementia mode) or error (json error + 413)")
+	fs.BoolVar(&c.LogTiming, "log-timing", false, "log where each request spent its time (parse=Xms upstream=Yms stream=Zms total=Wms)")
+	fs.StringVar(&c.ForwardOptions, "forward-options", "temperature,top_p,max_tokens,seed,stop,frequency_penalty,presence_penalty", "comma separated request options forwarded to the v2 endpoint (everything else is dropped)")
+	fs.DurationVar(&c.ChunkDelay, "chunk-delay", 10*time.Millisecond, "pause between streamed chunks (0 = as fast as possible, some slow web clients need a few ms)")
+	fs.IntVar(&c.ChunkSize, "chunk-size", 10, "about how many characters go in each streamed chunk (words are never split)")
+	fs.BoolVar(&c.InstantFirstChunk, "instant-first-chunk", false, "send the first streamed chunk with no delay (the delay still applies between the rest)")
+	fs.StringVar(&c.DisableModels, "disable-models", "", "comma separated models to turn off (e.g. dall-e-3,base64), they disappear from the model list and requests for them get an error. gpt-3.5 also covers unknown models")
+	fs.IntVar(&c.Retries, "retries", 2, "how many times to retry a failed upstream request (only failures listed in -retry-on)")
+	fs.DurationVar(&c.RetryDelay, "retry-delay", 500*time.Millisecond, "wait before the first retry, doubles on every retry after that")
+	fs.StringVar(&c.RetryOn, "retry-on", "429", "comma separated failures worth retrying: 429, html (cloudflare block), 5xx, empty, network")
+	fs.BoolVar(&c.RevisedPrompt, "revised-prompt", false, "show dall-e's revised_prompt (how it rewrote the request) on a line before each image url. options.revised_prompt overrides it per request")
+	fs.StringVar(&c.Base64Format, "base64-format", "markdown", "how the base64 model's image gets returned: markdown (![generated](data:...) in the content), images (ollama images field) or raw (the bare base64 string). options.image_format overrides it per request")
+	fs.Int64Var(&c.MaxDownloadSize, "max-download-size", 20<<20, "max bytes of a generated image/audio file the proxy downloads for inline features (bigger ones get a \"generated file too large\" message)")
+	fs.Float64Var(&c.IPRate, "ip-rate", 0, "chat/generate requests per minute allowed per client ip, 0 turns the per ip limit off")
+	fs.IntVar(&c.IPBurst, "ip-burst", 5, "requests a client ip can send back to back before -ip-rate applies")
+	fs.BoolVar(&c.IPLimitLocalhost, "ip-limit-localhost", false, "apply -ip-rate to localhost clients too (they're exempt by default)")
+	fs.BoolVar(&c.ReportUsage, "report-usage", false, "add an openai style usage object (prompt_tokens, completion_tokens, total_tokens, estimated) to the final chat/generate frame and /v1/chat/completions replies")
+	fs.BoolVar(&c.SanitizeStream, "sanitize-stream", true, "strip line feeds and control characters (U+0000-U+001F except tab, and U+007F) from streamed replies, -sanitize-stream=false sends them untouched")
+	fs.BoolVar(&c.NoPrewarm, "no-prewarm", false, "don't send the warm up request to the upstream at startup")
+	fs.BoolVar(&c.NoContentLogs, "no-content-logs", false, "never log message or reply text (even in debug), only model/message count/length/endpoint/status/latency")
+	fs.StringVar(&c.Alias, "alias", "", "comma separated model aliases as name=target (e.g. assistant=gpt-4o), they route to the target and get listed in /api/tags")
+	fs.StringVar(&c.DefaultModel, "default-model", "gpt-3.5", "model used when a request has no (or an empty) model field, replies carry this name too")
+	fs.StringVar(&c.SystemPrompt, "system-prompt", "", "system message prepended to every chat/generate request, before the client's own system message (counts toward the length limits, raw generate requests skip it)")
+	fs.Var(&c.UpstreamHeader, "upstream-header", "extra header for every upstream call as \"Key: Value\" (e.g. \"Authorization: Bearer xyz\"), repeat the flag for more than one")
+	fs.StringVar(&c.APIKey, "api-key", "", "bearer token required on /api/chat, /api/generate, /v1/chat/completions, the embeddings endpoints and /api/copy, /api/delete (empty = no auth). /, /api/tags and the other info endpoints stay open")
+	fs.StringVar(&c.AdminToken, "admin-token", "", "bearer token required by the /admin endpoints (they're turned off when this is empty)")
+	fs.BoolVar(&c.BlockTaskSpam, "block-task-spam", true, "block \"### Task:\" requests (open webui titles, tags, autocomplete) so they don't eat the ratelimit, -block-task-spam=false lets them through")
+	fs.StringVar(&c.TaskScope, "task-scope", "latest", "which messages get checked for \"### Task:\" spam: latest (only the newest user message) or all")
+	fs.StringVar(&c.Stream, "stream", "", "on (always stream), off (never stream) or ask (the service decides), skips the startup question")
+	fs.StringVar(&c.Dementia, "dementia", "", "on or off to set dementia mode without the startup question (ask keeps the question)")
+	fs.Var(&c.Debug, "debug", "turn the debug level logs on or off (beats OLLAMAGPT_DEBUG)")
+	fs.StringVar(&c.LogFormat, "log-format", "text", "log output format: text or json (one object per line)")
+	fs.StringVar(&c.LogLevel, "log-level", "", "lowest log level shown: debug, info, warn or error (info and below includes the access log). beats -debug, when it's not given debug mode means debug and everything else info")
+	fs.StringVar(&c.OllamaVersion, "ollama-version", "0.9.6", "ollama version reported by /api/version (some clients are picky about it)")
+	fs.StringVar(&c.EmbeddingsURL, "embeddings-url", "", "openai compatible embeddings endpoint (e.g. http://127.0.0.1:8080/v1/embeddings) used by /api/embeddings, off when empty")
+	fs.Float64Var(&c.CharsPerToken, "chars-per-token", 4, "characters per token for the estimate used when trimming long prompts (tune it for your upstream, 0 trims by raw byte length)")
+	fs.BoolVar(&c.StrictModels, "strict-models", false, "reply with a 404 json error for models that aren't in the model list instead of falling back to gpt-3.5")
+	fs.DurationVar(&c.ChatTimeout, "chat-timeout", 60*time.Second, "how long a chat upstream call may take (per attempt, retries get their own)")
+	fs.DurationVar(&c.ImageTimeout, "image-timeout", 3*time.Minute, "how long a dall-e-3/base64 upstream call may take (per attempt)")
+	fs.DurationVar(&c.TTSTimeout, "tts-timeout", 2*time.Minute, "how long a tts upstream call may take (per attempt)")
+	fs.DurationVar(&c.ShutdownGrace, "shutdown-grace", 10*time.Second, "how long running requests get to finish after ctrl+c/SIGTERM before they're cut off")
+	fs.IntVar(&c.MaxConcurrent, "max-concurrent", 8, "how many requests can be talking to the upstream at once (0 = no limit), the rest wait their turn")
+	fs.DurationVar(&c.QueueTimeout, "queue-timeout", 30*time.Second, "how long a request waits for a free -max-concurrent slot before getting a \"server busy\" reply")
+	fs.StringVar(&c.Limits, "limits", "", "prompt length limits per model category, e.g. gpt4=16000,default=4000 (categories: gpt4, default, image, tts), beats OLLAMAGPT_LIMITS")
+	fs.StringVar(&c.ModelsFile, "models-file", "", "json file with the model list /api/tags advertises (same shape as /api/tags or a bare array), the built in list is used without it")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", 0, "answer identical chat requests (same model, messages and options) from memory for this long, 0 turns the cache off")
+	fs.IntVar(&c.CacheSize, "cache-size", 256, "how many replies -cache-ttl keeps around (least recently used ones get dropped first)")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "certificate file to serve https with (needs -tls-key too)")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "private key file for -tls-cert")
+	fs.StringVar(&c.EmptyReply, "empty-reply", "upstream returned an empty response", "reply sent instead of an empty upstream reply (filtered content etc.) so clients don't sit on a stream with nothing in it, -empty-reply= passes empty replies on")
+	fs.IntVar(&c.MaxMessages, "max-messages", 500, "refuse chat requests with more messages than this (checked before dementia mode trims anything, 0 = no limit)")
+	fs.IntVar(&c.MaxReplyChars, "max-reply-chars", 1000000, "truncate upstream replies longer than this many bytes (done_reason becomes length, 0 = no limit)")
+}
+
+// validate catches flag values that would otherwise silently do nothing
+func (c *config) validate() error {
+	c.Upstream = strings.TrimSuffix(c.Upstream, "/")
+	if c.Upstream == "" {
+		return fmt.Errorf("-upstream can't be empty")
+	}
+	c.upstreams = []string{c.Upstream}
+	if c.Upstreams != "" {
+		c.upstreams = nil
+		for _, u := range strings.Split(c.Upstreams, ",") {
+			if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u != "" {
+				c.upstreams = append(c.upstreams, u)
+			}
+		}
+		if len(c.upstreams) == 0 {
+			return fmt.Errorf("-upstreams has no urls in it")
+		}
+		c.Upstream = c.upstreams[0] // the primary for everything that only talks to one
+	}
+	c.upstreamHeader = http.Header{}
+	for _, h := range c.UpstreamHeader {
+		key, value, ok := strings.Cut(h, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return fmt.Errorf("-upstream-header: %q isn't \"Key: Value\"", h)
+		}
+		c.upstreamHeader.Add(key, strings.TrimSpace(value))
+	}
+	c.aliases = map[string]string{}
+	for _, pair := range strings.Split(c.Alias, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, target, ok := strings.Cut(pair, "=")
+		name, target = baseModelName(strings.TrimSpace(name)), baseModelName(strings.TrimSpace(target))
+		if !ok || name == "" || target == "" {
+			return fmt.Errorf("-alias wants name=target pairs (got %q)", pair)
+		}
+		if name == target {
+			return fmt.Errorf("-alias %q points at itself", pair)
+		}
+		c.aliases[name] = target
+	}
+	c.corsOrigins = map[string]bool{}
+	for _, o := range strings.Split(c.CORSOrigin, ",") {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			c.corsOrigins[o] = true
+		}
+	}
+	if c.IPRate < 0 {
+		return fmt.Errorf("-ip-rate can't be negative (got %v)", c.IPRate)
+	}
+	if c.IPRate > 0 && c.IPBurst < 1 {
+		return fmt.Errorf("-ip-burst has to be at least 1 when -ip-rate is set (got %d)", c.IPBurst)
+	}
+	switch c.OnOverlength {
+	case "block", "trim", "error":
+	default:
+		return fmt.Errorf("-on-overlength must be block, trim or error (got %q)", c.OnOverlength)
+	}
+	if !validBase64Format(c.Base64Format) {
+		return fmt.Errorf("-base64-format must be markdown, images or raw (got %q)", c.Base64Format)
+	}
+	if c.TaskScope != "latest" && c.TaskScope != "all" {
+		return fmt.Errorf("-task-scope must be latest or all (got %q)", c.TaskScope)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key have to be given together (https needs both the certificate and its key)")
+	}
+	if c.ChunkSize <= 0 {
+		return fmt.Errorf("-chunk-size must be positive")
+	}
+	if c.CacheTTL > 0 && c.CacheSize <= 0 {
+		return fmt.Errorf("-cache-size must be positive when -cache-ttl is set")
+	}
+	if c.MaxMessages < 0 {
+		return fmt.Errorf("-max-messages can't be negative")
+	}
+	if c.MaxConcurrent < 0 {
+		return fmt.Errorf("-max-concurrent can't be negative")
+	}
+	if c.LogFormat != "text" && c.LogFormat != "json" {
+		return fmt.Errorf("-log-format must be text or json (got %q)", c.LogFormat)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); c.LogLevel != "" && err != nil {
+		return fmt.Errorf("-log-level must be debug, info, warn or error (got %q)", c.LogLevel)
+	}
+	switch c.Stream {
+	case "", "on", "off", "ask":
+	default:
+		return fmt.Errorf("-stream must be on, off or ask (got %q)", c.Stream)
+	}
+	switch c.Dementia {
+	case "", "on", "off", "ask":
+	default:
+		return fmt.Errorf("-dementia must be on, off or ask (got %q)", c.Dementia)
+	}
+	if c.ChatTimeout <= 0 || c.ImageTimeout <= 0 || c.TTSTimeout <= 0 {
+		return fmt.Errorf("-chat-timeout, -image-timeout and -tts-timeout must be positive")
+	}
+	limits, err := parseLimits(os.Getenv("OLLAMAGPT_LIMITS"), c.Limits)
+	if err != nil {
+		return err
+	}
+	c.limits = limits
+	c.forwardOptions = splitSet(c.ForwardOptions)
+	c.disabledModels = splitSet(c.DisableModels)
+	c.retryOn = splitSet(c.RetryOn)
+	for class := range c.retryOn {
+		if !retryClasses[class] {
+			return fmt.Errorf("-retry-on: unknown failure class %q", class)
+		}
+	}
+	for name := range c.disabledModels {
+		if modelRoute(name) != name {
+			return fmt.Errorf("-disable-models: unknown model %q", name)
+		}
+	}
+	return nil
+}
+
+// stringList is a string flag that can be given more than once, every use adds an entry
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// optionalBool is a bool flag that also remembers if it was given at all (so "not set" can fall back to something else)
+type optionalBool struct {
+	set   bool
+	value bool
+}
+
+func (o *optionalBool) String() string {
+	if o == nil || !o.set {
+		return ""
+	}
+	return strconv.FormatBool(o.value)
+}
+
+func (o *optionalBool) Set(s string) error {
+	v, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	o.set, o.value = true, v
+	return nil
+}
+
+func (o *optionalBool) IsBoolFlag() bool { return true }
+
+// debugFromEnv reads OLLAMAGPT_DEBUG: 0, false and empty mean off, anything else on. ok is false when it isn't set
+func debugFromEnv() (on bool, ok bool) {
+	v, ok := os.LookupEnv("OLLAMAGPT_DEBUG")
+	if !ok {
+		return false, false
+	}
+	v = strings.ToLower(strings.TrimSpace(v))
+	return v != "" && v != "0" && v != "false", true
+}
+
+// debugMode reports if debug logging is on: -debug beats OLLAMAGPT_DEBUG which beats whatever debug was compiled with
+func (c *config) debugMode() bool {
+	if c.Debug.set {
+		return c.Debug.value
+	}
+	if on, ok := debugFromEnv(); ok {
+		return on
+	}
+	return debug
+}
+
+// loadConfig builds a config the same way every time: flag defaults, then the config file, then the command line on top
+func loadConfig(args []string, errorHandling flag.ErrorHandling) (*config, error) {
+	c := &config{}
+	fs := flag.NewFlagSet(os.Args[0], errorHandling)
+	c.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if c.ConfigFile != "" {
+		setOnCLI := map[string]bool{}
+		fs.Visit(func(f *flag.Flag) { setOnCLI[f.Name] = true })
+		if err := loadConfigFile(fs, c.ConfigFile, setOnCLI); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reloadConfig re-reads the config file and swaps the new values in. a broken file keeps the old config and stuff
+// that needs a restart (listen address) keeps its old value with a warning
+func reloadConfig() {
+	old := conf()
+	next, err := loadConfig(os.Args[1:], flag.ContinueOnError)
+	if err != nil {
+		slog.Warn("config reload failed keeping the old config", "err", err)
+		return
+	}
+	if next.Listen != old.Listen || next.TLSCert != old.TLSCert || next.TLSKey != old.TLSKey {
+		slog.Warn("listen address and tls files can't change without a restart", "listen", old.Listen)
+		next.Listen, next.TLSCert, next.TLSKey = old.Listen, old.TLSCert, old.TLSKey
+	}
+	if next.MaxConcurrent != old.MaxConcurrent {
+		slog.Warn("max-concurrent only gets picked up on restart", "max_concurrent", old.MaxConcurrent)
+		next.MaxConcurrent = old.MaxConcurrent
+	}
+	if next.Stream != old.Stream || next.Dementia != old.Dementia || next.LogFormat != old.LogFormat {
+		slog.Warn("stream/dementia/log-format only get picked up on restart")
+		next.Stream, next.Dementia, next.LogFormat = old.Stream, old.Dementia, old.LogFormat
+	}
+	// -log-level and -debug go live straight away, the logger reads the level on every call
+	if level := effectiveLogLevel(next.LogLevel, next.debugMode()); level != logLevel.Level() {
+		slog.Info("log level changed", "from", logLevel.Level(), "to", level)
+		logLevel.Set(level)
+	}
+	liveCfg.Store(next)
+	if err := reloadTags(next); err != nil {
+		slog.Warn("rebuilding model list failed", "err", err)
+	}
+	slog.Info("config reloaded", "file", next.ConfigFile)
+}
+
+// loadConfigFile applies a json config file onto fs. keys are flag names (no dash) and values can be strings, numbers,
+// bools or arrays (arrays set a repeatable flag once per item). anything set on the command line is left alone so it wins
+func loadConfigFile(fs *flag.FlagSet, path string, setOnCLI map[string]bool) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file map[string]interface{}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for name, v := range file {
+		if name == "config" || setOnCLI[name] {
+			continue
+		}
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		vals, ok := v.([]interface{})
+		if !ok {
+			vals = []interface{}{v}
+		}
+		for _, val := range vals {
+			str := fmt.Sprint(val)
+			if f, ok := val.(float64); ok {
+				str = strconv.FormatFloat(f, 'f', -1, 64) // fmt would turn 1000000 into 1e+06 which int flags can't parse
+			}
+			if err := fs.Set(name, str); err != nil {
+				return fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+		}
+	}
+	return nil
+}
+
 // HTTP client (shared) just makes requests faster
+// (no client wide Timeout, every call gets a context deadline from the -*-timeout flags instead)
 var sharedHTTPClient = &http.Client{
-	Timeout: 60 * time.Second,
 	Transport: &http.Transport{
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
@@ -45,21 +561,28 @@ var sharedHTTPClient = &http.Client{
 
 // ollamaReq is the request format for ollama
 type ollamaReq struct {
-	Model    string      `json:"model"`
-	Messages []msg       `json:"messages"`
-	Stream   bool        `json:"stream,omitempty"`
-	Options  interface{} `json:"options,omitempty"`
+	Model     string        `json:"model"`
+	Messages  []msg         `json:"messages"`
+	Stream    *bool         `json:"stream,omitempty"` // nil = not sent (ollama streams by default)
+	Options   ollamaOptions `json:"options,omitempty"`
+	KeepAlive interface{}   `json:"keep_alive,omitempty"` // "5m" or seconds depending on the client, accepted and ignored
+	Format    interface{}   `json:"format,omitempty"`     // "json" or a json schema object, asks for a json only reply
+	Think     interface{}   `json:"think,omitempty"`      // true/false or a level like "high" (newer clients), false strips <think> blocks
+	Raw       bool          `json:"-"`                    // only set by /api/generate (raw:true means no templating at all)
 }
 
 // msg is the message format for ollama
 type msg struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"` // base64 images (vision clients), only the v2 models can take them
 }
 
 // chatReq is the request format for pfuner.xyz
 type chatReq struct {
-	Messages []string `json:"messages"`
+	Messages    []string `json:"messages"`
+	Temperature *float64 `json:"temperature,omitempty"` // only sent when the client gave one
+	TopP        *float64 `json:"top_p,omitempty"`
 }
 
 // chatResp is the response format for pfuner.xyz
@@ -70,123 +593,136 @@ type chatResp struct {
 
 // ollamaResp is the response format for ollama (chat only yes i made /api/generate actually work yippe)
 type ollamaResp struct {
-	Model              string `json:"model"`
-	CreatedAt          string `json:"created_at"`
-	Message            msg    `json:"message"`
-	DoneReason         string `json:"done_reason,omitempty"`
-	Done               bool   `json:"done"`
-	TotalDuration      int64  `json:"total_duration,omitempty"`
-	LoadDuration       int64  `json:"load_duration,omitempty"`
-	PromptEvalCount    int    `json:"prompt_eval_count,omitempty"`
-	PromptEvalDuration int64  `json:"prompt_eval_duration,omitempty"`
-	EvalCount          int    `json:"eval_count,omitempty"`
-	EvalDuration       int64  `json:"eval_duration,omitempty"`
+	Model              string      `json:"model"`
+	CreatedAt          string      `json:"created_at"`
+	Message            msg         `json:"message"`
+	DoneReason         string      `json:"done_reason,omitempty"`
+	Done               bool        `json:"done"`
+	TotalDuration      int64       `json:"total_duration,omitempty"`
+	LoadDuration       int64       `json:"load_duration,omitempty"`
+	PromptEvalCount    int         `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64       `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int         `json:"eval_count,omitempty"`
+	EvalDuration       int64       `json:"eval_duration,omitempty"`
+	UpstreamMs         int64       `json:"upstream_ms,omitempty"` // non standard only filled in with -expose-upstream-ms
+	Seed               *int        `json:"seed,omitempty"`        // non standard, options.seed echoed back on the final frame
+	Usage              *tokenUsage `json:"usage,omitempty"`       // non standard only filled in with -report-usage
 }
 
 // ollamaGenerateResp is the response format for ollama generate (api/generate)
 type ollamaGenerateResp struct {
-	Model              string `json:"model"`
-	CreatedAt          string `json:"created_at"`
-	Response           string `json:"response"`
-	DoneReason         string `json:"done_reason,omitempty"`
-	Done               bool   `json:"done"`
-	TotalDuration      int64  `json:"total_duration,omitempty"`
-	LoadDuration       int64  `json:"load_duration,omitempty"`
-	PromptEvalCount    int    `json:"prompt_eval_count,omitempty"`
-	PromptEvalDuration int64  `json:"prompt_eval_duration,omitempty"`
-	EvalCount          int    `json:"eval_count,omitempty"`
-	EvalDuration       int64  `json:"eval_duration,omitempty"`
-}
-
-func preWarmConnection() {
-	if debug {
-		fmt.Println("[DEBUG] prewarming connection to pfuner.xyz (just makes messages a bit faster)")
-	}
+	Model              string      `json:"model"`
+	CreatedAt          string      `json:"created_at"`
+	Response           string      `json:"response"`
+	DoneReason         string      `json:"done_reason,omitempty"`
+	Done               bool        `json:"done"`
+	TotalDuration      int64       `json:"total_duration,omitempty"`
+	LoadDuration       int64       `json:"load_duration,omitempty"`
+	PromptEvalCount    int         `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64       `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int         `json:"eval_count,omitempty"`
+	EvalDuration       int64       `json:"eval_duration,omitempty"`
+	UpstreamMs         int64       `json:"upstream_ms,omitempty"` // non standard only filled in with -expose-upstream-ms
+	Seed               *int        `json:"seed,omitempty"`        // non standard, options.seed echoed back on the final frame
+	Usage              *tokenUsage `json:"usage,omitempty"`       // non standard only filled in with -report-usage
+}
+
+// preWarmConnection opens a connection to the upstream (-upstream, or the first -upstreams entry) with a throwaway
+// v1 request so the first real message doesn't pay for the tls handshake
+func preWarmConnection(cfg *config) {
+	slog.Debug("prewarming connection to the upstream (just makes messages a bit faster)", "upstream", cfg.Upstream)
 	helloReq := chatReq{
 		Messages: []string{"hello world"},
 	}
 	reqBody, _ := json.Marshal(helloReq)
-	resp, err := sharedHTTPClient.Post("https://pfuner.xyz/v1/chat/completions", "application/json", bytes.NewBuffer(reqBody))
-	if err != nil {
-		if debug {
-			fmt.Printf("[DEBUG] prewarmup failed (this is normal just ignore and continue) %v\n", err)
-		}
+	if _, _, err := postWithTimeout(context.Background(), cfg.ChatTimeout, cfg.Upstream+"/v1/chat/completions", "application/json", cfg.upstreamHeader, reqBody); err != nil {
+		slog.Debug("prewarmup failed (this is normal just ignore and continue)", "err", err)
 		return
 	}
-	defer resp.Body.Close()
 
-	if debug {
-		fmt.Println("[DEBUG] prewarmup successful connection is ready have fun")
-	}
+	slog.Debug("prewarmup successful connection is ready have fun")
 }
 
 // main function (starts the server)
 func main() {
-	var input string
-	inputCh := make(chan string, 1)
-	go func() {
-		fmt.Print("Force streaming? (on/off/ask): ")
-		fmt.Scanln(&input)
-		inputCh <- input
-	}()
-	select {
-	case input = <-inputCh:
-		input = strings.ToLower(strings.TrimSpace(input))
-		if input == "on" {
-			b := true
-			streamOverride = &b
-			fmt.Println("Streaming will always be ON for this session")
-		} else if input == "off" {
-			b := false
-			streamOverride = &b
-			fmt.Println("Streaming will always be OFF for this session")
-		} else {
-			streamOverride = nil
-			fmt.Println("Streaming will be decided per request of the service")
-		}
-	case <-time.After(10 * time.Second):
-		streamOverride = nil
-		fmt.Println("\nno input in 10s defaulting to ask (basically the service decides) mode.")
+	cfg, err := loadConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		log.Fatal(err)
 	}
-	if dementiaOverride == nil {
-		dementiaCh := make(chan string, 1)
+	liveCfg.Store(cfg)
+	setupLogger(cfg.LogFormat, cfg.LogLevel, cfg.debugMode())
+	if cfg.MaxConcurrent > 0 {
+		upstreamSlots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	if cfg.ConfigFile != "" {
+		// kill -HUP reloads the config file without dropping anyone
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 		go func() {
-			fmt.Print("Press 'p' to enable dementia mode (basically if you're using a service that is a chatbot enable this): ")
-			var dementiaInput string
-			fmt.Scanln(&dementiaInput)
-			dementiaCh <- dementiaInput
-		}()
-		select {
-		case dementiaInput := <-dementiaCh:
-			if strings.ToLower(strings.TrimSpace(dementiaInput)) == "p" {
-				b := true
-				dementiaOverride = &b
-				fmt.Println("dementia mode enabled long messages will be automatically trimmed")
-			} else {
-				b := false
-				dementiaOverride = &b
-				fmt.Println("dementia mode disabled")
+			for range hup {
+				reloadConfig()
 			}
-		case <-time.After(3 * time.Second):
-			b := false
-			dementiaOverride = &b
-			fmt.Println("\nno input in 3s dementia mode disabled")
-		}
+		}()
+	}
+
+	// -stream / -dementia skip the questions entirely (needed for systemd/docker where nobody is there to answer)
+	switch cfg.Stream {
+	case "on":
+		b := true
+		streamOverride = &b
+		fmt.Println("Streaming will always be ON for this session")
+	case "off":
+		b := false
+		streamOverride = &b
+		fmt.Println("Streaming will always be OFF for this session")
+	case "ask":
+		streamOverride = nil
+		fmt.Println("Streaming will be decided per request of the service")
+	default:
+		askStream()
+	}
+	switch cfg.Dementia {
+	case "on":
+		b := true
+		dementiaOverride = &b
+	case "off":
+		b := false
+		dementiaOverride = &b
+	}
+	if dementiaOverride == nil {
+		askDementia()
 	} else if *dementiaOverride {
 		fmt.Println("dementia mode forced ON long messages will be trimmed")
 	} else {
 		fmt.Println("dementia mode forced OFF")
 	}
 
+	if err := reloadTags(cfg); err != nil {
+		log.Fatalf("building model list: %v", err)
+	}
+
 	// Pre-warm the connection in the background
-	go preWarmConnection()
+	if !cfg.NoPrewarm {
+		go preWarmConnection(cfg)
+	}
 	http.HandleFunc("/api/chat", hChat)
 	http.HandleFunc("/api/generate", hChat)
+	http.HandleFunc("/v1/chat/completions", hOpenAIChat)
 	http.HandleFunc("/api/tags", hTags)
+	http.HandleFunc("/api/show", hShow)
+	http.HandleFunc("/api/pull", hPull)
+	http.HandleFunc("/api/blobs/", hBlobs)
+	http.HandleFunc("/api/copy", hCopy)
+	http.HandleFunc("/api/delete", hDelete)
+	http.HandleFunc("/api/ps", hPs)
+	http.HandleFunc("/api/embeddings", hEmbeddings)
+	http.HandleFunc("/api/embed", hEmbed)
+	http.HandleFunc("/api/version", hVersion)
+	http.HandleFunc("/healthz", hHealth)
+	http.HandleFunc("/admin/stats", hStats)
+	http.HandleFunc("/metrics", hMetrics)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		setCORS(w, r, "GET, OPTIONS")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -197,188 +733,471 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("Ollama is running")) //spoofs the fact that ollama is running cuz some services relay on it
 	})
-	prt := ":11434"
-	fmt.Printf("starting server on http://127.0.0.1%s\n", prt)
+	prt := cfg.Listen
+	scheme := "http"
+	if cfg.TLSCert != "" {
+		scheme = "https"
+	}
+	if strings.HasPrefix(prt, ":") {
+		fmt.Printf("starting server on %s://127.0.0.1%s\n", scheme, prt)
+	} else {
+		fmt.Printf("starting server on %s://%s\n", scheme, prt)
+	}
 	fmt.Println("please make sure to close ollama before continuing")
 	fmt.Println("all requests with invalid models be redirected to pfuner.xyz/v1/chat/completions (AKA GPT-3.5)")
-	log.Fatal(http.ListenAndServe(prt, nil))
+	srv := &http.Server{Addr: prt, Handler: trackActive(accessLog(http.DefaultServeMux))}
+	// ctrl+c / SIGTERM stop taking new connections and let running streams finish (up to -shutdown-grace)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-stop
+		grace := conf().ShutdownGrace
+		slog.Info("shutting down", "active_requests", activeRequests.Load(), "grace", grace)
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("grace period over, cutting off requests", "active_requests", activeRequests.Load(), "err", err)
+			srv.Close()
+		}
+		close(shutdownDone)
+	}()
+	if cfg.TLSCert != "" {
+		err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	fmt.Println("bye")
 }
 
-// handler for requests to /api/chat and /api/generate :D
-func hChat(w http.ResponseWriter, r *http.Request) {
-	// allows all cors cuz some apps require them
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+// logLevel is the level the default logger filters at, a config reload can change it without a new handler
+var logLevel = new(slog.LevelVar)
 
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
+// setupLogger points the default slog logger at stderr in the given format, at the level effectiveLogLevel picks
+func setupLogger(format, minLevel string, debug bool) {
+	logLevel.Set(effectiveLogLevel(minLevel, debug))
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
 	}
+	slog.SetDefault(slog.New(handler))
+}
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// effectiveLogLevel is -log-level when it was given (so -log-level=warn works without -debug=false), otherwise debug
+// level in debug mode and info without
+func effectiveLogLevel(minLevel string, debug bool) slog.Level {
+	if minLevel != "" {
+		var level slog.Level
+		level.UnmarshalText([]byte(minLevel)) // already checked by validate
+		return level
+	}
+	if debug {
+		return slog.LevelDebug
 	}
+	return slog.LevelInfo
+}
 
-	isGenerateRequest := r.URL.Path == "/api/generate"
+// ipBucket is one client ip's token bucket, tokens refill continuously up to -ip-burst
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
 
-	var req ollamaReq
-	//same thing as chat except entirely different
-	if isGenerateRequest {
-		var generateReq struct {
-			Model   string      `json:"model"`
-			Prompt  string      `json:"prompt"`
-			System  string      `json:"system,omitempty"`
-			Stream  bool        `json:"stream,omitempty"`
-			Options interface{} `json:"options,omitempty"`
-		}
+// ipBuckets is the -ip-rate limiter, keyed by client ip. buckets that filled back up get dropped once the map grows
+// so it can't balloon with every ip that ever connected
+type ipBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*ipBucket
+}
 
-		if err := json.NewDecoder(r.Body).Decode(&generateReq); err != nil {
-			http.Error(w, "invalid json", http.StatusBadRequest)
-			return
-		}
+var ipLimiter = &ipBuckets{buckets: map[string]*ipBucket{}}
 
-		req.Model = generateReq.Model
-		req.Stream = generateReq.Stream
-		req.Options = generateReq.Options
-		if generateReq.System != "" {
-			req.Messages = append(req.Messages, msg{
-				Role:    "system",
-				Content: generateReq.System,
-			})
-		}
-		req.Messages = append(req.Messages, msg{
-			Role:    "user",
-			Content: generateReq.Prompt,
-		})
-	} else {
-		// added the system ability so u can declare a personallity or roleplay for the sick freaks of you out there
-		var raw map[string]interface{}
-		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
-			http.Error(w, "invalid json", http.StatusBadRequest)
-			return
-		}
-		b, _ := json.Marshal(raw)
-		if err := json.Unmarshal(b, &req); err != nil {
-			http.Error(w, "invalid json", http.StatusBadRequest)
-			return
-		}
-		if sys, ok := raw["system"]; ok {
-			if sysStr, ok := sys.(string); ok && sysStr != "" {
-				req.Messages = append([]msg{{Role: "system", Content: sysStr}}, req.Messages...)
+// allow takes a token from the remote address's bucket, false means it's out and the request should be refused
+func (l *ipBuckets) allow(cfg *config, remoteAddr string, now time.Time) bool {
+	if cfg.IPRate <= 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() && !cfg.IPLimitLocalhost {
+		return true
+	}
+	perSecond, burst := cfg.IPRate/60, float64(cfg.IPBurst)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.buckets) > 4096 {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*perSecond >= burst {
+				delete(l.buckets, k)
 			}
 		}
 	}
-	model := req.Model
-	baseModel := model
-	if strings.HasSuffix(model, ":latest") {
-		baseModel = strings.TrimSuffix(model, ":latest")
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &ipBucket{tokens: burst, last: now}
+		l.buckets[host] = b
 	}
-	var endpoint string
-	var reqBody []byte
-	contentType := "application/json"
-	isChatStream := false
-	isV2 := false
-	switch baseModel {
-	case "gpt-4o", "gpt-4o-mini", "gpt-4.1-nano", "gpt-4.1-mini", "gpt-4.1":
-		// detects and blocks any request to do unnecessary api intensive tasks such as suggesting next question/chat name you can disable if u want i recommend not to (causes alot of unnecessary issues with ratelimits)
-		for _, m := range req.Messages {
-			if strings.Contains(m.Content, "### Task:") {
-				if debug {
-					fmt.Printf("[DEBUG] Blocked request (unnecessary api spam)\n")
-				}
-				w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
 
-				var respBytes []byte
-				if isGenerateRequest {
-					ollamaErrResp := ollamaGenerateResp{
-						Model:      model,
-						CreatedAt:  nowRFC(),
-						Response:   "Request blocked due to unnecessary api spam  (trying to predict next messages/chatname)",
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
-				} else {
-					ollamaErrResp := ollamaResp{
-						Model:     model,
-						CreatedAt: nowRFC(),
-						Message: msg{
-							Role:    "assistant",
-							Content: "Request blocked due to unnecessary api spam (trying to predict next messages/chatname)",
-						},
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
+// upstreamSlots is the -max-concurrent semaphore (nil = no limit)
+var upstreamSlots chan struct{}
+
+// acquireSlot waits up to timeout for a free upstream slot, false means it gave up (or the client hung up)
+func acquireSlot(ctx context.Context, timeout time.Duration) bool {
+	if upstreamSlots == nil {
+		return true
+	}
+	select {
+	case upstreamSlots <- struct{}{}:
+		return true
+	default:
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case upstreamSlots <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false // client left while waiting
+	}
+}
+
+func releaseSlot() {
+	if upstreamSlots != nil {
+		<-upstreamSlots
+	}
+}
+
+// activeRequests counts requests currently being handled (reported on shutdown)
+var activeRequests atomic.Int64
+
+// trackActive keeps activeRequests up to date around every request
+func trackActive(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Add(1)
+		defer activeRequests.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessLog logs one info line per request (method, path, model for chat requests, status, duration). the body only
+// gets peeked at for the model when info logging is actually on
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slog.Default().Enabled(r.Context(), slog.LevelInfo) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		model := ""
+		if r.Method == http.MethodPost && (r.URL.Path == "/api/chat" || r.URL.Path == "/api/generate" || r.URL.Path == "/v1/chat/completions") {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if err == nil {
+				var peek struct {
+					Model string `json:"model"`
 				}
-				w.Write(respBytes)
-				w.Write([]byte("\n"))
-				return
+				json.Unmarshal(body, &peek)
+				model = peek.Model
 			}
 		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		attrs := []interface{}{"method", r.Method, "path", r.URL.Path, "status", sw.status, "duration_ms", time.Since(start).Milliseconds()}
+		if model != "" {
+			attrs = append(attrs, "model", model)
+		}
+		slog.Info("request", attrs...)
+	})
+}
 
-		totalLength := 0
-		for _, m := range req.Messages {
-			totalLength += len(m.Content)
+// askStream asks on the console if streaming should be forced (used when -stream isn't given)
+func askStream() {
+	var input string
+	inputCh := make(chan string, 1)
+	go func() {
+		fmt.Print("Force streaming? (on/off/ask): ")
+		fmt.Scanln(&input)
+		inputCh <- input
+	}()
+	select {
+	case input = <-inputCh:
+		input = strings.ToLower(strings.TrimSpace(input))
+		if input == "on" {
+			b := true
+			streamOverride = &b
+			fmt.Println("Streaming will always be ON for this session")
+		} else if input == "off" {
+			b := false
+			streamOverride = &b
+			fmt.Println("Streaming will always be OFF for this session")
+		} else {
+			streamOverride = nil
+			fmt.Println("Streaming will be decided per request of the service")
 		}
+	case <-time.After(10 * time.Second):
+		streamOverride = nil
+		fmt.Println("\nno input in 10s defaulting to ask (basically the service decides) mode.")
+	}
+}
 
-		if totalLength > 8000 {
-			if dementiaOverride != nil && *dementiaOverride {
-				if debug {
-					fmt.Printf("[DEBUG] GPT prompt too long (%d chars) using dementia mode to trim it down\n", totalLength)
-				}
-				req.Messages = circumsizeM(req.Messages, 8000)
-			} else {
-				if debug {
-					fmt.Printf("[DEBUG] GPT prompt too long (%d chars) blocking request (use dementia mode if u want the messages to just be trimmed down)\n", totalLength)
-				}
-				w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
+// askDementia asks on the console if dementia mode should be on (used when -dementia isn't given)
+func askDementia() {
+	dementiaCh := make(chan string, 1)
+	go func() {
+		fmt.Print("Press 'p' to enable dementia mode (basically if you're using a service that is a chatbot enable this): ")
+		var dementiaInput string
+		fmt.Scanln(&dementiaInput)
+		dementiaCh <- dementiaInput
+	}()
+	select {
+	case dementiaInput := <-dementiaCh:
+		if strings.ToLower(strings.TrimSpace(dementiaInput)) == "p" {
+			b := true
+			dementiaOverride = &b
+			fmt.Println("dementia mode enabled long messages will be automatically trimmed")
+		} else {
+			b := false
+			dementiaOverride = &b
+			fmt.Println("dementia mode disabled")
+		}
+	case <-time.After(3 * time.Second):
+		b := false
+		dementiaOverride = &b
+		fmt.Println("\nno input in 3s dementia mode disabled")
+	}
+}
 
-				var respBytes []byte
-				if isGenerateRequest {
-					ollamaErrResp := ollamaGenerateResp{
-						Model:      model,
-						CreatedAt:  nowRFC(),
-						Response:   "prompt too long please keep it under 8000 characters (or simply enable dementia mode next time on runtime)",
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
-				} else {
-					ollamaErrResp := ollamaResp{
-						Model:     model,
-						CreatedAt: nowRFC(),
-						Message: msg{
-							Role:    "assistant",
-							Content: "prompt too long please keep it under 8000 characters (or simply enable dementia mode next time on runtime)",
-						},
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
-				}
-				w.Write(respBytes)
-				w.Write([]byte("\n"))
-				return
+// handler for requests to /api/chat and /api/generate :D
+func hChat(w http.ResponseWriter, r *http.Request) {
+	// cors cuz some apps require them (all origins unless -cors-origin says otherwise)
+	setCORS(w, r, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// broken requests and upstream failures get a real http status + {"error": ...} (ollama's error shape) while
+	// stuff the model "says" (blocked, too long, ratelimited) stays a 200 ndjson frame so chat UIs just show it
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !apiKeyAuthorized(w, r) {
+		return
+	}
+	// browser clients asking for server sent events get every ndjson line as a data: event instead
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		sse := &sseWriter{ResponseWriter: w}
+		defer sse.finish()
+		w = sse
+	}
+
+	cfg := conf()
+	timing := reqTiming{start: time.Now()}
+	if cfg.LogTiming {
+		defer func() {
+			slog.Info("request timing", "path", r.URL.Path, "timing", timing.summary(time.Now()))
+		}()
+	}
+	// feeds /admin/stats (status is captured so rejected requests can be told apart from in-band ones)
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	w = sw
+	statModel, upstreamClass := "unknown", ""
+	defer func() {
+		class := upstreamClass
+		if class == "" && sw.status >= 400 {
+			class = "rejected" // bad json, disabled model, over the limit in error mode...
+		} else if class == "" && timing.parsed.IsZero() {
+			class = "blocked" // answered without ever reaching upstream (task spam, too long)
+		}
+		stats.record(statModel, time.Since(timing.start), class)
+		metrics.request(statModel, class == "blocked")
+	}()
+	isGenerateRequest := r.URL.Path == "/api/generate"
+
+	var req ollamaReq
+	//same thing as chat except entirely different
+	if isGenerateRequest {
+		var generateReq struct {
+			Model     string        `json:"model"`
+			Prompt    string        `json:"prompt"`
+			Suffix    string        `json:"suffix,omitempty"` // fill in the middle: text that comes after the completion
+			System    string        `json:"system,omitempty"`
+			Stream    *bool         `json:"stream,omitempty"`
+			Raw       bool          `json:"raw,omitempty"`
+			Images    []string      `json:"images,omitempty"`
+			Options   ollamaOptions `json:"options,omitempty"`
+			KeepAlive interface{}   `json:"keep_alive,omitempty"` // string or number, nothing to unload here so it's ignored
+			Format    interface{}   `json:"format,omitempty"`
+			Think     interface{}   `json:"think,omitempty"` // bool or "low"/"medium"/"high"
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&generateReq); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+
+		req.Model = generateReq.Model
+		req.Stream = generateReq.Stream
+		req.Options = generateReq.Options
+		req.Think = generateReq.Think
+		req.Raw = generateReq.Raw
+		req.Format = generateReq.Format
+		// raw means the client did its own prompt formatting so the prompt gets sent as is with no system message
+		if generateReq.System != "" && !generateReq.Raw {
+			req.Messages = append(req.Messages, msg{
+				Role:    "system",
+				Content: generateReq.System,
+			})
+		}
+		prompt := generateReq.Prompt
+		if generateReq.Suffix != "" {
+			prompt = fillInMiddlePrompt(prompt, generateReq.Suffix)
+		}
+		req.Messages = append(req.Messages, msg{
+			Role:    "user",
+			Content: prompt,
+			Images:  generateReq.Images,
+		})
+	} else {
+		// added the system ability so u can declare a personallity or roleplay for the sick freaks of you out there
+		var raw map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		b, _ := json.Marshal(raw)
+		if err := json.Unmarshal(b, &req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+		// nothing to answer, the upstream would just make something up (checked before the system prompt joins in)
+		if len(req.Messages) == 0 {
+			writeJSONError(w, http.StatusBadRequest, "no messages provided")
+			return
+		}
+		if sys, ok := raw["system"]; ok {
+			if sysStr, ok := sys.(string); ok && sysStr != "" {
+				req.Messages = append([]msg{{Role: "system", Content: sysStr}}, req.Messages...)
+			}
+		}
+	}
+	if strings.TrimSpace(req.Model) == "" {
+		slog.Debug("no model given, using -default-model", "model", cfg.DefaultModel)
+		req.Model = cfg.DefaultModel
+	}
+	model := req.Model // replies keep the name exactly as asked, tag and all
+	baseModel := resolveAlias(baseModelName(model))
+	statModel = modelRoute(baseModel)
+	if route := modelRoute(baseModel); cfg.disabledModels[route] {
+		slog.Debug("model is disabled (-disable-models)", "model", route)
+		writeJSONError(w, http.StatusForbidden, fmt.Sprintf("model %q is disabled", model))
+		return
+	}
+	if _, known := findTagModel(baseModel); cfg.StrictModels && !known {
+		slog.Debug("unknown model refused (-strict-models)", "model", model)
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("model %q not found", model))
+		return
+	}
+	// thousands of tiny messages pass every length check one by one but still blow up memory and the upstream payload
+	if cfg.MaxMessages > 0 && len(req.Messages) > cfg.MaxMessages {
+		slog.Debug("too many messages (-max-messages)", "messages", len(req.Messages), "limit", cfg.MaxMessages)
+		writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("too many messages (%d, limit is %d)", len(req.Messages), cfg.MaxMessages))
+		return
+	}
+	markModelUsed(statModel)
+	if !acceptsImages(statModel) && hasImages(req.Messages) {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("model %q can't take images (use gpt-4o, gpt-4o-mini or a gpt-4.1 model)", model))
+		return
+	}
+	// -ip-rate: one noisy client shouldn't eat the shared upstream quota (same message the upstream's own 429 gets)
+	if !ipLimiter.allow(cfg, r.RemoteAddr, time.Now()) {
+		slog.Debug("client over its -ip-rate budget", "remote", r.RemoteAddr)
+		writeOllamaError(w, model, isGenerateRequest, "Too many requests please wait a min... (contact atticus if you think higher request limits should be set)")
+		return
+	}
+	// echo never touches the upstream, the last user message comes straight back through the normal reply path so
+	// integrations can be tested without burning quota
+	if statModel == "echo" {
+		echoed := ""
+		for _, m := range req.Messages {
+			if m.Role == "user" {
+				echoed = m.Content
 			}
 		}
+		timing.parsed = time.Now()
+		timing.upstreamDone = timing.parsed
+		writeChatReply(r.Context(), w, cfg, req, model, isGenerateRequest, echoed, 0, timing)
+		return
+	}
+	// -system-prompt goes first so the client's own system message can still build on it, raw prompts stay untouched
+	if cfg.SystemPrompt != "" && !req.Raw && isChatRoute(statModel) {
+		req.Messages = append([]msg{{Role: "system", Content: cfg.SystemPrompt}}, req.Messages...)
+	}
+	// format:"json" has no upstream equivalent so the model gets told in a system message and the reply is checked later
+	// (raw prompts don't get the instruction added, their reply still gets checked and retried)
+	jsonInstruction := formatInstruction(req.Format)
+	if !isChatRoute(statModel) {
+		jsonInstruction = ""
+	} else if jsonInstruction != "" && !req.Raw {
+		req.Messages = withSystemInstruction(req.Messages, jsonInstruction)
+	}
+	// only -max-concurrent requests get to the upstream at once (firing everything at it just earns 429s)
+	if !acquireSlot(r.Context(), cfg.QueueTimeout) {
+		slog.Warn("no free upstream slot, answering server busy", "model", model, "waited", cfg.QueueTimeout)
+		writeOllamaError(w, model, isGenerateRequest, "Server is busy with other requests please try again in a bit...")
+		return
+	}
+	defer releaseSlot()
+	var endpoint string // path on the upstream, the base gets picked by doUpstreams
+	var reqBody []byte
+	contentType := "application/json"
+	isChatStream := false
+	isV2 := false
+	switch baseModel {
+	case "gpt-4o", "gpt-4o-mini", "gpt-4.1-nano", "gpt-4.1-mini", "gpt-4.1":
+		// detects and blocks any request to do unnecessary api intensive tasks such as suggesting next question/chat name you can disable it with -block-task-spam=false if u want i recommend not to (causes alot of unnecessary issues with ratelimits)
+		if ok, gerr := guardTaskSpam(cfg, taskScanScope(cfg, req.Messages)); !ok {
+			gerr.write(w, model, isGenerateRequest)
+			return
+		}
+		trimmed, ok, gerr := guardLength(cfg, req.Messages, cfg.limits[limitCategory(statModel)])
+		if !ok {
+			gerr.write(w, model, isGenerateRequest)
+			return
+		}
+		req.Messages = trimmed
 
-		endpoint = "https://pfuner.xyz/v2/chat/completions"
+		endpoint = "/v2/chat/completions"
 		temp := 0.7
-		if opts, ok := req.Options.(map[string]interface{}); ok {
-			if t, ok := opts["temperature"].(float64); ok {
-				temp = t
-			}
+		if req.Options.Temperature != nil {
+			temp = *req.Options.Temperature
 		}
+		// a raw generate prompt is the lone user message here (v2 needs a role on everything, nothing else gets added)
 		var openaiMsgs []map[string]interface{}
 		for _, m := range req.Messages {
 			openaiMsgs = append(openaiMsgs, map[string]interface{}{
 				"role":    m.Role,
-				"content": m.Content,
+				"content": openAIContent(m),
 			})
 		}
 		uhhobjofchatReq := map[string]interface{}{
@@ -386,170 +1205,67 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 			"messages":    openaiMsgs,
 			"temperature": temp,
 		}
-		reqBody, _ = json.Marshal(uhhobjofchatReq)
-		if debug {
-			fmt.Println("[DEBUG] Sending to pfuner.xyz/v2/chat/completions:", string(reqBody))
+		if req.Options.Seed != nil && cfg.forwardOptions["seed"] {
+			slog.Debug("forwarding seed, the upstream may ignore it so same seed doesn't guarantee the same reply")
+		}
+		// only options on the allowlist get forwarded (random ollama options like num_ctx can make the upstream choke)
+		if opts := req.Options.raw; opts != nil {
+			for k, v := range opts {
+				if k == "temperature" {
+					continue // already handled above
+				}
+				if !cfg.forwardOptions[k] {
+					slog.Debug("dropping option (not in -forward-options)", "option", k)
+					continue
+				}
+				uhhobjofchatReq[k] = v
+			}
 		}
+		reqBody, _ = json.Marshal(uhhobjofchatReq)
+		debugContent(cfg, "Sending to pfuner.xyz/v2/chat/completions", string(reqBody))
 		isChatStream = true
 		isV2 = true
 	case "dall-e-3":
-		endpoint = "https://pfuner.xyz/v3/images/generations"
+		endpoint = "/v3/images/generations"
 		prompt := ""
 		if len(req.Messages) > 0 {
 			prompt = req.Messages[len(req.Messages)-1].Content
 		}
-		if strings.Contains(prompt, "### Task:") {
-			if debug {
-				fmt.Printf("[DEBUG] Blocked unnecessary api spam\n")
-			}
-			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-
-			var respBytes []byte
-			if isGenerateRequest {
-				ollamaErrResp := ollamaGenerateResp{
-					Model:      model,
-					CreatedAt:  nowRFC(),
-					Response:   "Request blocked due to unnecessary api spam",
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			} else {
-				ollamaErrResp := ollamaResp{
-					Model:     model,
-					CreatedAt: nowRFC(),
-					Message: msg{
-						Role:    "assistant",
-						Content: "Request blocked due to unnessary api spam",
-					},
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			}
-			w.Write(respBytes)
-			w.Write([]byte("\n"))
+		if ok, gerr := guardTaskSpam(cfg, []msg{{Role: "user", Content: prompt}}); !ok {
+			gerr.write(w, model, isGenerateRequest)
 			return
 		}
-		if len(prompt) > 1000 {
-			if debug {
-				fmt.Printf("[DEBUG] DALL-E prompt too long (%d chars) blocking request\n", len(prompt))
-			}
-			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-
-			var respBytes []byte
-			if isGenerateRequest {
-				ollamaErrResp := ollamaGenerateResp{
-					Model:      model,
-					CreatedAt:  nowRFC(),
-					Response:   "please keep the text under 1000 characters (btw using image generation in chat mode is not smart)",
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			} else {
-				ollamaErrResp := ollamaResp{
-					Model:     model,
-					CreatedAt: nowRFC(),
-					Message: msg{
-						Role:    "assistant",
-						Content: "please keep the text under 1000 characters (btw using image generation in chat mode is not smart)",
-					},
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			}
-			w.Write(respBytes)
-			w.Write([]byte("\n"))
+		if ok, gerr := guardPromptLength(prompt, cfg.limits[limitCategory(statModel)], "image generation"); !ok {
+			gerr.write(w, model, isGenerateRequest)
 			return
 		}
 
+		size, n, err := imageOptions(req.Options)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		imgReq := map[string]interface{}{
 			"model":  baseModel,
 			"prompt": prompt,
-			"size":   "1024x1024",
-			"n":      1,
+			"size":   size,
+			"n":      n,
 		}
 		reqBody, _ = json.Marshal(imgReq)
-		if debug {
-			fmt.Println("[DEBUG] Sending to pfuner.xyz/v3/images/generations:", string(reqBody))
-		}
+		debugContent(cfg, "Sending to pfuner.xyz/v3/images/generations", string(reqBody))
 	case "base64":
-		endpoint = "https://pfuner.xyz/v4/images/generations"
+		endpoint = "/v4/images/generations"
 		prompt := ""
 		if len(req.Messages) > 0 {
 			prompt = req.Messages[len(req.Messages)-1].Content
 		}
 
-		if strings.Contains(prompt, "### Task:") {
-			if debug {
-				fmt.Printf("[DEBUG] Blocked unnecessary api spam\n")
-			}
-			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-
-			var respBytes []byte
-			if isGenerateRequest {
-				ollamaErrResp := ollamaGenerateResp{
-					Model:      model,
-					CreatedAt:  nowRFC(),
-					Response:   "Request blocked due to unnecessary api spam",
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			} else {
-				ollamaErrResp := ollamaResp{
-					Model:     model,
-					CreatedAt: nowRFC(),
-					Message: msg{
-						Role:    "assistant",
-						Content: "Request blocked due to unnessary api spam",
-					},
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			}
-			w.Write(respBytes)
-			w.Write([]byte("\n"))
+		if ok, gerr := guardTaskSpam(cfg, []msg{{Role: "user", Content: prompt}}); !ok {
+			gerr.write(w, model, isGenerateRequest)
 			return
 		}
-		if len(prompt) > 1000 {
-			if debug {
-				fmt.Printf("[DEBUG] Base64 prompt too long (%d chars) blocking request\n", len(prompt))
-			}
-			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-
-			var respBytes []byte
-			if isGenerateRequest {
-				ollamaErrResp := ollamaGenerateResp{
-					Model:      model,
-					CreatedAt:  nowRFC(),
-					Response:   "please keep the text under 1000 characters (btw using image generation in chat mode is not smart)",
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			} else {
-				ollamaErrResp := ollamaResp{
-					Model:     model,
-					CreatedAt: nowRFC(),
-					Message: msg{
-						Role:    "assistant",
-						Content: "please keep the text under 1000 characters (btw using image generation in chat mode is not smart)",
-					},
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			}
-			w.Write(respBytes)
-			w.Write([]byte("\n"))
+		if ok, gerr := guardPromptLength(prompt, cfg.limits[limitCategory(statModel)], "image generation"); !ok {
+			gerr.write(w, model, isGenerateRequest)
 			return
 		}
 
@@ -558,432 +1274,204 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 		}
 		reqBody, _ = json.Marshal(imgReq)
 	case "tts":
-		endpoint = "https://pfuner.xyz/v5/audio/generations"
+		endpoint = "/v5/audio/generations"
 		text := ""
 		if len(req.Messages) > 0 {
 			text = req.Messages[len(req.Messages)-1].Content
 		}
+		voice, text := pickVoice(req.Options, text)
 
-		if strings.Contains(text, "### Task:") {
-			if debug {
-				fmt.Printf("[DEBUG] Blocked unnecessary api spam\n")
-			}
-			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-
-			var respBytes []byte
-			if isGenerateRequest {
-				ollamaErrResp := ollamaGenerateResp{
-					Model:      model,
-					CreatedAt:  nowRFC(),
-					Response:   "Request blocked due to unnecessary api spam",
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			} else {
-				ollamaErrResp := ollamaResp{
-					Model:     model,
-					CreatedAt: nowRFC(),
-					Message: msg{
-						Role:    "assistant",
-						Content: "Request blocked due to unnessary api spam",
-					},
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			}
-			w.Write(respBytes)
-			w.Write([]byte("\n"))
-			return
-		}
-		if len(text) > 500 {
-			if debug {
-				fmt.Printf("[DEBUG] TTS text too long (%d chars) blocking request\n", len(text))
-			}
-			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-			w.WriteHeader(http.StatusOK)
-
-			var respBytes []byte
-			if isGenerateRequest {
-				ollamaErrResp := ollamaGenerateResp{
-					Model:      model,
-					CreatedAt:  nowRFC(),
-					Response:   "please keep the text under 500 characters (btw using tts in chat is not smart)",
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			} else {
-				ollamaErrResp := ollamaResp{
-					Model:     model,
-					CreatedAt: nowRFC(),
-					Message: msg{
-						Role:    "assistant",
-						Content: "please keep the text under 500 characters (btw using tts in chat is not smart)",
-					},
-					DoneReason: "stop",
-					Done:       true,
-				}
-				respBytes, _ = json.Marshal(ollamaErrResp)
-			}
-			w.Write(respBytes)
-			w.Write([]byte("\n"))
+		if ok, gerr := guardTaskSpam(cfg, []msg{{Role: "user", Content: text}}); !ok {
+			gerr.write(w, model, isGenerateRequest)
+			return
+		}
+		if ok, gerr := guardPromptLength(text, cfg.limits[limitCategory(statModel)], "tts"); !ok {
+			gerr.write(w, model, isGenerateRequest)
 			return
 		}
 
 		ttsReq := map[string]interface{}{
 			"text": text,
 		}
+		if voice != "" {
+			ttsReq["voice"] = voice
+		}
 		reqBody, _ = json.Marshal(ttsReq)
 	default:
-		if debug {
-			fmt.Printf("[DEBUG] Model '%s' not matched, falling back to v1 endpoint\n", baseModel)
-		}
-
-		// detects and blocks any request to do unnecessary api intensive tasks such as suggesting next question/chat name you can disable if u want i recommend not to (causes alot of unnecessary issues with ratelimits)
-		for _, m := range req.Messages {
-			if strings.Contains(m.Content, "### Task:") {
-				if debug {
-					fmt.Printf("[DEBUG] Blocked request (unnecessary api spam)\n")
-				}
-				w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
-
-				var respBytes []byte
-				if isGenerateRequest {
-					ollamaErrResp := ollamaGenerateResp{
-						Model:      model,
-						CreatedAt:  nowRFC(),
-						Response:   "Request blocked due to unnecessary api spam (trying to predict next messages/chatname)",
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
-				} else {
-					ollamaErrResp := ollamaResp{
-						Model:     model,
-						CreatedAt: nowRFC(),
-						Message: msg{
-							Role:    "assistant",
-							Content: "Request blocked due to unnecessary api spam (trying to predict next messages/chatname)",
-						},
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
-				}
-				w.Write(respBytes)
-				w.Write([]byte("\n"))
-				return
-			}
-		}
+		slog.Debug("model not matched, falling back to v1 endpoint", "model", baseModel)
 
-		totalLength := 0
-		for _, m := range req.Messages {
-			totalLength += len(m.Content)
+		// detects and blocks any request to do unnecessary api intensive tasks such as suggesting next question/chat name you can disable it with -block-task-spam=false if u want i recommend not to (causes alot of unnecessary issues with ratelimits)
+		if ok, gerr := guardTaskSpam(cfg, taskScanScope(cfg, req.Messages)); !ok {
+			gerr.write(w, model, isGenerateRequest)
+			return
 		}
-
-		if totalLength > 2000 {
-			if dementiaOverride != nil && *dementiaOverride {
-				if debug {
-					fmt.Printf("[DEBUG] Default model prompt too long (%d chars) using dementia mode to trim it down\n", totalLength)
-				}
-				req.Messages = circumsizeM(req.Messages, 2000)
-			} else {
-				if debug {
-					fmt.Printf("[DEBUG] Default model prompt too long (%d chars) blocking request (use dementia mode if u want the messages to just be trimmed down)\n", totalLength)
-				}
-				w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-				w.WriteHeader(http.StatusOK)
-
-				var respBytes []byte
-				if isGenerateRequest {
-					ollamaErrResp := ollamaGenerateResp{
-						Model:      model,
-						CreatedAt:  nowRFC(),
-						Response:   "prompt too long please keep it under 2000 characters (or simply enable dementia mode next time on runtime)",
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
-				} else {
-					ollamaErrResp := ollamaResp{
-						Model:     model,
-						CreatedAt: nowRFC(),
-						Message: msg{
-							Role:    "assistant",
-							Content: "prompt too long please keep it under 2000 characters (or simply enable dementia mode next time on runtime)",
-						},
-						DoneReason: "stop",
-						Done:       true,
-					}
-					respBytes, _ = json.Marshal(ollamaErrResp)
-				}
-				w.Write(respBytes)
-				w.Write([]byte("\n"))
-				return
-			}
+		trimmed, ok, gerr := guardLength(cfg, req.Messages, cfg.limits[limitCategory(statModel)])
+		if !ok {
+			gerr.write(w, model, isGenerateRequest)
+			return
 		}
+		req.Messages = trimmed
 
-		endpoint = "https://pfuner.xyz/v1/chat/completions"
+		endpoint = "/v1/chat/completions"
 		var messages []string
 		for _, m := range req.Messages {
-			messages = append(messages, m.Content)
+			// v1 only takes plain strings so every turn gets its role in front otherwise old assistant replies just look
+			// like more user text (a lone message and raw prompts go as is)
+			if len(req.Messages) == 1 || req.Raw {
+				messages = append(messages, m.Content)
+				continue
+			}
+			messages = append(messages, v1RolePrefix(m.Role)+m.Content)
 		}
 		chatReq := chatReq{
 			Messages: messages,
 		}
-		fmt.Printf("[DEBUG] Sending message", messages)
+		// v1 only knows temperature and top_p, still goes through the -forward-options allowlist like v2
+		if req.Options.Seed != nil {
+			slog.Debug("v1 has no seed, it only gets echoed back in the reply")
+		}
+		if cfg.forwardOptions["temperature"] {
+			chatReq.Temperature = req.Options.Temperature
+		}
+		if cfg.forwardOptions["top_p"] {
+			chatReq.TopP = req.Options.TopP
+		}
 		reqBody, _ = json.Marshal(chatReq)
+		debugContent(cfg, "Sending to pfuner.xyz/v1/chat/completions", string(reqBody))
 		isChatStream = true
 	}
-	if debug {
-		fmt.Printf("[DEBUG] Sending request to %s\n", endpoint)
+	slog.Debug("sending request", "endpoint", endpoint)
+	timing.parsed = time.Now()
+	// -cache-ttl: the upstream body already holds the model, messages and options so identical requests share a key
+	cacheKey := ""
+	if isChatStream && cfg.CacheTTL > 0 {
+		cacheKey = replyCacheKey(endpoint, reqBody)
+		if hit, ok := replyCache.get(cacheKey); ok {
+			stats.cacheLookup(true)
+			slog.Debug("reply cache hit", "model", model)
+			writeChatReply(r.Context(), w, cfg, req, model, isGenerateRequest, hit.reply, hit.upstreamMs, timing)
+			return
+		}
+		stats.cacheLookup(false)
 	}
-	resp, err := sharedHTTPClient.Post(endpoint, contentType, bytes.NewBuffer(reqBody))
-	if err != nil {
-		http.Error(w, "[ERROR] forwarding request...", http.StatusInternalServerError)
+	var resp *http.Response
+	var body []byte
+	var err error
+	upstreamPath := endpoint
+	upstreamCall := func() {
+		var base string
+		resp, body, base, err = doUpstreams(r.Context(), cfg, upstreamPath, contentType, reqBody, isChatStream, cfg.upstreamTimeout(statModel))
+		endpoint = base + upstreamPath
+	}
+	// dall-e takes ages so streaming clients get an empty frame every second meanwhile (keeps spinners and idle timeouts happy)
+	if baseModel == "dall-e-3" && wantsStream(req) {
+		if keepAliveWhile(w, time.Second, func() []byte { return keepaliveFrame(model, isGenerateRequest) }, upstreamCall) {
+			w = &keepaliveWriter{ResponseWriter: w, header: http.Header{}}
+		}
+	} else {
+		upstreamCall()
+	}
+	timing.upstreamDone = time.Now()
+	if r.Context().Err() != nil {
+		slog.Debug("client went away before the upstream answered", "model", model)
+		upstreamClass = "canceled"
 		return
 	}
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	if resp != nil {
+		upstreamClass = upstreamFailure(resp.StatusCode, body, err, isChatStream)
+	} else {
+		upstreamClass = upstreamFailure(0, body, err, isChatStream)
+	}
+	metrics.upstream(statModel, timing.upstreamDone.Sub(timing.parsed), upstreamClass)
+	if cfg.NoContentLogs {
+		// metadata only (this line shows up even with debug off)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		totalChars := 0
+		for _, m := range req.Messages {
+			totalChars += len(m.Content)
+		}
+		slog.Info("upstream request", "model", model, "messages", len(req.Messages), "chars", totalChars, "endpoint", endpoint, "status", status, "latency_ms", timing.upstreamDone.Sub(timing.parsed).Milliseconds())
+	}
 	if err != nil {
-		http.Error(w, "[ERROR] reading response...", http.StatusInternalServerError)
+		writeJSONError(w, http.StatusBadGateway, "[ERROR] forwarding request...")
 		return
 	}
 
 	// Check if response is HTML (likely blocked by Cloudflare or other protection)
-	if strings.HasPrefix(string(body), `{"reply":"<!DOCTYPE html>\`) || strings.HasPrefix(string(body), "<html>") {
-		if debug {
-			fmt.Printf("[DEBUG] HTML response detected, likely blocked by Cloudflare\n")
-		}
-		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-
-		var respBytes []byte
-		if isGenerateRequest {
-			ollamaErrResp := ollamaGenerateResp{
-				Model:      model,
-				CreatedAt:  nowRFC(),
-				Response:   "Response was blocked please try again in a minute...",
-				DoneReason: "stop",
-				Done:       true,
-			}
-			respBytes, _ = json.Marshal(ollamaErrResp)
-		} else {
-			ollamaErrResp := ollamaResp{
-				Model:     model,
-				CreatedAt: nowRFC(),
-				Message: msg{
-					Role:    "assistant",
-					Content: "Response was blocked please try again in a minute...",
-				},
-				DoneReason: "stop",
-				Done:       true,
-			}
-			respBytes, _ = json.Marshal(ollamaErrResp)
-		}
-		w.Write(respBytes)
-		w.Write([]byte("\n"))
+	if isHTMLBlock(body) {
+		slog.Warn("HTML response detected, likely blocked by Cloudflare")
+		writeOllamaError(w, model, isGenerateRequest, "Response was blocked please try again in a minute...")
 		return
 	}
 
 	//added support for x-ndjson + fixed some problems with the /api/generate ratelimit errors
-	if resp.StatusCode == 429 || strings.Contains(string(body), "\"Too many requests (\"") {
-		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-
-		var respBytes []byte
-		if isGenerateRequest {
-			ollamaErrResp := ollamaGenerateResp{
-				Model:      model,
-				CreatedAt:  nowRFC(),
-				Response:   "Too many requests please wait a min... (contact atticus if you think higher request limits should be set)",
-				DoneReason: "stop",
-				Done:       true,
+	if isRateLimited(resp.StatusCode, body) {
+		wait := "a min"
+		if d, ok := retryAfter(resp, time.Now()); ok {
+			wait = d.Round(time.Second).String()
+			if d < time.Second {
+				wait = "a second"
 			}
-			respBytes, _ = json.Marshal(ollamaErrResp)
-		} else {
-			ollamaErrResp := ollamaResp{
-				Model:     model,
-				CreatedAt: nowRFC(),
-				Message: msg{
-					Role:    "assistant",
-					Content: "Too many requests please wait a min... (contact atticus if you think higher request limits should be set)",
-				},
-				DoneReason: "stop",
-				Done:       true,
-			}
-			respBytes, _ = json.Marshal(ollamaErrResp)
 		}
-		w.Write(respBytes)
-		w.Write([]byte("\n"))
+		writeOllamaError(w, model, isGenerateRequest, fmt.Sprintf("Too many requests please wait %s... (contact atticus if you think higher request limits should be set)", wait))
 		return
 	}
-	if debug {
-		fmt.Println("[DEBUG] pfuner.xyz replied:", string(body))
+	// any other non 2xx is an upstream failure not a reply, so don't even try to parse it as one
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.Warn("upstream returned an error status", "status", resp.StatusCode, "endpoint", endpoint)
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("upstream returned status %d (%s)", resp.StatusCode, http.StatusText(resp.StatusCode)))
+		return
 	}
+	debugContent(cfg, "pfuner.xyz replied", string(body))
 	createdAt := nowRFC()
 	if isChatStream {
-		reply := ""
-		if isV2 {
-			var v2 struct {
-				Content string `json:"content"`
-				Ms      int64  `json:"ms"`
-			}
-			if err := json.Unmarshal(body, &v2); err != nil {
-				http.Error(w, "[ERROR] parsing v2 response...", http.StatusInternalServerError)
-				return
-			}
-			reply = v2.Content
-		} else {
-			var uhhchatresp chatResp
-			if err := json.Unmarshal(body, &uhhchatresp); err != nil {
-				http.Error(w, "[ERROR] parsing response...", http.StatusInternalServerError)
-				return
-			}
-			reply = uhhchatresp.Reply
-		}
-		// global override to prevent service from changing it
-		stream := req.Stream
-		if streamOverride != nil {
-			stream = *streamOverride
-		} else {
-			// fixed issues in some services by setting stream to on unless said otherwise by the service in ask mode
-			stream = true
+		reply, upstreamMs, parseErr := parseChatReply(resp, body, isV2)
+		if parseErr != "" {
+			writeJSONError(w, http.StatusBadGateway, parseErr)
+			return
 		}
-		if stream {
-			// actually proper x-ndjson (and no i don't have an idea on why half of this is a requirement but without it shit just turned into base64😭)
-			w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
-			w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-			w.Header().Set("Pragma", "no-cache")
-			w.Header().Set("Expires", "0")
-			w.Header().Set("Connection", "keep-alive")
-			w.Header().Set("Transfer-Encoding", "chunked")
-			w.Header().Set("X-Accel-Buffering", "no")
-			w.Header().Set("Access-Control-Expose-Headers", "Content-Type")
-			w.WriteHeader(http.StatusOK)
-			// Remove all U+000A (Line Feed) characters from reply
-			reply = strings.ReplaceAll(reply, "\n", "")
-			cleaned := make([]rune, 0, len(reply))
-			for _, r := range reply {
-				// changed a bit to support new x-ndjson working properly
-				if (r >= 0x20 && r <= 0x7E) || r == 0x09 || (r >= 0x80) {
-					cleaned = append(cleaned, r)
-				}
-			}
-			reply = string(cleaned)
-			flusher, ok := w.(http.Flusher)
-			if !ok {
-				http.Error(w, "unsupported stream...", http.StatusInternalServerError)
-				return
-			}
-			// Stream shit in chunks to be faster and require less jsons (probably foreshadowing but might cause some problems in future)
-			chunkSize := 10
-			for i := 0; i < len(reply); i += chunkSize {
-				end := i + chunkSize
-				if end > len(reply) {
-					end = len(reply)
+		if jsonInstruction != "" {
+			var ok bool
+			if reply, ok = cleanJSONReply(reply); !ok {
+				// one more go, models mostly get it right the second time
+				slog.Debug("reply isn't valid json, asking again (format json)", "model", model)
+				upstreamCall()
+				if r.Context().Err() != nil {
+					return
 				}
-				chunk := reply[i:end]
-
-				var respBytes []byte
-				if isGenerateRequest {
-					generateResp := ollamaGenerateResp{
-						Model:     model,
-						CreatedAt: createdAt,
-						Response:  chunk,
-						Done:      false,
-					}
-					respBytes, _ = json.Marshal(generateResp)
-				} else {
-					chatResp := ollamaResp{
-						Model:     model,
-						CreatedAt: createdAt,
-						Message: msg{
-							Role:    "assistant",
-							Content: chunk,
-						},
-						Done: false,
+				if err == nil && upstreamFailure(resp.StatusCode, body, nil, true) == "" && resp.StatusCode <= 299 {
+					if retried, retriedMs, parseErr := parseChatReply(resp, body, isV2); parseErr == "" {
+						reply, upstreamMs = retried, retriedMs
 					}
-					respBytes, _ = json.Marshal(chatResp)
-				}
-
-				// Ensure proper JSON line separation with explicit newline
-				w.Write(respBytes)
-				w.Write([]byte("\n"))
-				flusher.Flush()
-				time.Sleep(10 * time.Millisecond) //yes it's pretty much required for some web services which are slow in the brain
-			}
-			// spoofs final metadata that is present in ollama WHY idk but some services need it so...
-			var finalrespbytes []byte
-			//modified a bit to work with /api/generate
-			if isGenerateRequest {
-				finalResp := ollamaGenerateResp{
-					Model:              model,
-					CreatedAt:          createdAt,
-					Response:           "",
-					DoneReason:         "stop",
-					Done:               true,
-					TotalDuration:      4768114600, // Example values, replace with real timing if needed (probably not required)
-					LoadDuration:       2497832600,
-					PromptEvalCount:    84,
-					PromptEvalDuration: 491959200,
-					EvalCount:          37,
-					EvalDuration:       1746310500,
 				}
-				finalrespbytes, _ = json.Marshal(finalResp)
-			} else {
-				finalResp := ollamaResp{
-					Model:              model,
-					CreatedAt:          createdAt,
-					Message:            msg{Role: "assistant", Content: ""},
-					DoneReason:         "stop",
-					Done:               true,
-					TotalDuration:      4768114600, // Example values, replace with real timing if needed (probably not required)
-					LoadDuration:       2497832600,
-					PromptEvalCount:    84,
-					PromptEvalDuration: 491959200,
-					EvalCount:          37,
-					EvalDuration:       1746310500,
+				if reply, ok = cleanJSONReply(reply); !ok {
+					slog.Warn("reply still isn't valid json, wrapping it (format json)", "model", model)
+					wrapped, _ := json.Marshal(map[string]string{"response": reply})
+					reply = string(wrapped)
 				}
-				finalrespbytes, _ = json.Marshal(finalResp)
 			}
-			w.Write(finalrespbytes)
-			w.Write([]byte("\n"))
-			flusher.Flush()
+		}
+		// an empty stream followed by done looks like a hang to some clients, so they get told instead (and it's not cached)
+		if strings.TrimSpace(reply) == "" && cfg.EmptyReply != "" {
+			slog.Warn("upstream returned an empty reply", "model", model)
+			writeChatReply(r.Context(), w, cfg, req, model, isGenerateRequest, cfg.EmptyReply, upstreamMs, timing)
 			return
 		}
-		// single json for nostream /api/generate
-		var respBytes []byte
-		if isGenerateRequest {
-			generateResp := ollamaGenerateResp{
-				Model:      model,
-				CreatedAt:  createdAt,
-				Response:   reply,
-				DoneReason: "stop",
-				Done:       true,
-			}
-			respBytes, _ = json.Marshal(generateResp)
-		} else {
-			chatResp := ollamaResp{
-				Model:     model,
-				CreatedAt: createdAt,
-				Message: msg{
-					Role:    "assistant",
-					Content: reply,
-				},
-				DoneReason: "stop",
-				Done:       true,
-			}
-			respBytes, _ = json.Marshal(chatResp)
+		if cacheKey != "" {
+			replyCache.put(cacheKey, reply, upstreamMs, cfg.CacheTTL, cfg.CacheSize)
 		}
-		w.Write(respBytes)
-		w.Write([]byte("\n"))
+		writeChatReply(r.Context(), w, cfg, req, model, isGenerateRequest, reply, upstreamMs, timing)
 		return
 	}
+	// images/tts are one frame anyway but stream:false clients want a plain json object not ndjson
+	mediaStream := wantsStream(req)
+	mediaContentType := "application/json; charset=utf-8"
+	if mediaStream {
+		mediaContentType = "application/x-ndjson; charset=utf-8"
+	}
 	// Use baseModel for translation logic
 	if baseModel == "dall-e-3" {
 		var imgResp struct {
@@ -995,20 +1483,32 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 			Ms int64 `json:"ms"`
 		}
 		if err := json.Unmarshal(body, &imgResp); err != nil {
-			http.Error(w, "[ERROR] generating image (parsing the response)...", http.StatusInternalServerError)
+			writeJSONError(w, http.StatusBadGateway, "[ERROR] generating image (parsing the response)...")
 			return
 		}
-		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.Header().Set("Content-Type", mediaContentType)
 		w.WriteHeader(http.StatusOK)
 		flusher, ok := w.(http.Flusher)
 		if !ok {
 			http.Error(w, "unsupported stream...", http.StatusInternalServerError)
 			return
 		}
-		imageURL := ""
-		if len(imgResp.Data) > 0 {
-			imageURL = imgResp.Data[0].URL
+		// options.n > 1 gives one url per line (a single image is still just its url)
+		showRevised := cfg.RevisedPrompt
+		if v, ok := req.Options.raw["revised_prompt"].(bool); ok {
+			showRevised = v
+		}
+		var urls []string
+		for _, d := range imgResp.Data {
+			if d.URL == "" {
+				continue
+			}
+			if showRevised && d.RevisedPrompt != "" {
+				urls = append(urls, "Revised prompt: "+d.RevisedPrompt)
+			}
+			urls = append(urls, d.URL)
 		}
+		imageURL := strings.Join(urls, "\n")
 		var respBytes []byte
 		if isGenerateRequest {
 			generateResp := ollamaGenerateResp{
@@ -1043,10 +1543,10 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 			Ms     int64      `json:"ms"`
 		}
 		if err := json.Unmarshal(body, &base64Resp); err != nil {
-			http.Error(w, "[ERROR] generating base64...", http.StatusInternalServerError)
+			writeJSONError(w, http.StatusBadGateway, "[ERROR] generating base64...")
 			return
 		}
-		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.Header().Set("Content-Type", mediaContentType)
 		w.WriteHeader(http.StatusOK)
 		flusher, ok := w.(http.Flusher)
 		if !ok {
@@ -1057,12 +1557,36 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 		if len(base64Resp.Output) > 0 && len(base64Resp.Output[0]) > 0 {
 			base64str = base64Resp.Output[0][0]
 		}
+		format := cfg.Base64Format
+		if f := req.Options.str("image_format"); validBase64Format(f) {
+			format = f
+		}
+		content, images := base64ImageContent(base64str, format, isGenerateRequest)
+		// streaming clients get the (huge) string spread over frames like a chat reply, the final frame stays empty
+		if mediaStream {
+			for _, part := range runeChunks(content, base64ChunkSize) {
+				if r.Context().Err() != nil {
+					return
+				}
+				var frame []byte
+				if isGenerateRequest {
+					frame, _ = json.Marshal(ollamaGenerateResp{Model: model, CreatedAt: nowRFC(), Response: part})
+				} else {
+					frame, _ = json.Marshal(ollamaResp{Model: model, CreatedAt: nowRFC(), Message: msg{Role: "assistant", Content: part}})
+				}
+				w.Write(frame)
+				w.Write([]byte("\n"))
+				flusher.Flush()
+			}
+			content = ""
+			createdAt = nowRFC() // the done frame is stamped when it goes out like every other frame
+		}
 		var respBytes []byte
 		if isGenerateRequest {
 			generateResp := ollamaGenerateResp{
 				Model:      model,
 				CreatedAt:  createdAt,
-				Response:   base64str,
+				Response:   content,
 				DoneReason: "stop",
 				Done:       true,
 			}
@@ -1073,7 +1597,8 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 				CreatedAt: createdAt,
 				Message: msg{
 					Role:    "assistant",
-					Content: base64str,
+					Content: content,
+					Images:  images,
 				},
 				DoneReason: "stop",
 				Done:       true,
@@ -1090,10 +1615,27 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 			URL string `json:"url"`
 		}
 		if err := json.Unmarshal(body, &ttsResp); err != nil {
-			http.Error(w, "[ERROR] generating tts...", http.StatusInternalServerError)
+			writeJSONError(w, http.StatusBadGateway, "[ERROR] generating tts...")
 			return
 		}
-		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		content := ttsResp.URL
+		// options.inline swaps the url for the audio itself as a data uri (saves clients a fetch to another host)
+		if inline, _ := req.Options.raw["inline"].(bool); inline {
+			audio, audioType, err := downloadAsset(r.Context(), ttsResp.URL, cfg.MaxDownloadSize, cfg.TTSTimeout)
+			if errors.Is(err, errFileTooLarge) {
+				content = "generated file too large to inline, here's the link instead: " + ttsResp.URL
+			} else if err != nil {
+				slog.Error("downloading tts audio failed", "err", err)
+				writeJSONError(w, http.StatusBadGateway, "[ERROR] downloading tts audio...")
+				return
+			} else {
+				if audioType == "" {
+					audioType = "audio/mpeg"
+				}
+				content = "data:" + audioType + ";base64," + base64.StdEncoding.EncodeToString(audio)
+			}
+		}
+		w.Header().Set("Content-Type", mediaContentType)
 		w.WriteHeader(http.StatusOK)
 		flusher, ok := w.(http.Flusher)
 		if !ok {
@@ -1105,7 +1647,7 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 			generateResp := ollamaGenerateResp{
 				Model:      model,
 				CreatedAt:  createdAt,
-				Response:   ttsResp.URL,
+				Response:   content,
 				DoneReason: "stop",
 				Done:       true,
 			}
@@ -1116,7 +1658,7 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 				CreatedAt: createdAt,
 				Message: msg{
 					Role:    "assistant",
-					Content: ttsResp.URL,
+					Content: content,
 				},
 				DoneReason: "stop",
 				Done:       true,
@@ -1133,243 +1675,2841 @@ func hChat(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
-// spoofs which models are available allowing services to see all your options.
-func hTags(w http.ResponseWriter, r *http.Request) {
-	// Add CORS headers for tags endpoint
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
-		return
-	}
+// openAIReq is the part of an openai chat completions request the proxy understands
+type openAIReq struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role    string      `json:"role"`
+		Content interface{} `json:"content"` // plain string or a list of content parts
+	} `json:"messages"`
+	Stream      bool        `json:"stream"`
+	Temperature *float64    `json:"temperature,omitempty"`
+	TopP        *float64    `json:"top_p,omitempty"`
+	MaxTokens   *int        `json:"max_tokens,omitempty"`
+	Seed        *int        `json:"seed,omitempty"`
+	Stop        interface{} `json:"stop,omitempty"`
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	//changed everything to add :latest since doesn't work without it 🫠
-	w.Write([]byte(`{ 
-	"models": [
-		{
-			"name": "gpt-4o:latest",
-			"model": "gpt-4o:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "fuck you",
-				"format": "openai",
-				"family": "gpt-4o",
-				"families": ["gpt-4o"],
-				"parameter_size": "yes",
-				"quantization_level": "i"
-			}
-		},
-		{
-			"name": "gpt-4o-mini:latest",
-			"model": "gpt-4o-mini:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "don't",
-				"format": "openai",
-				"family": "gpt-4o-mini",
-				"families": ["gpt-4o-mini"],
-				"parameter_size": "know",
-				"quantization_level": "what"
-			}
-		},
-		{
-			"name": "gpt-4.1-nano:latest",
-			"model": "gpt-4.1-nano:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "to",
-				"format": "openai",
-				"family": "gpt-4.1-nano",
-				"families": ["gpt-4.1-nano"],
-				"parameter_size": "put",
-				"quantization_level": "here"
-			}
-		},
-		{
-			"name": "gpt-4.1-mini:latest",
-			"model": "gpt-4.1-mini:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "so",
-				"format": "fuck",
-				"family": "gpt-4.1-mini",
-				"families": ["gpt-4.1-mini"],
-				"parameter_size": "off",
-				"quantization_level": ":)" 
-			}
-		},
-		{
-			"name": "gpt-4.1:latest",
-			"model": "gpt-4.1:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "too",
-				"format": "openai",
-				"family": "gpt-4.1",
-				"families": ["gpt-4.1"],
-				"parameter_size": "many",
-				"quantization_level": "models"
-			}
-		},
-		{
-			"name": "gpt-3.5:latest",
-			"model": "gpt-3.5:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "i",
-				"format": "openai",
-				"family": "gpt-3.5",
-				"families": ["gpt-3.5"],
-				"parameter_size": "s",
-				"quantization_level": "t"
-			}
-		},
-		{
-			"name": "tts:latest",
-			"model": "tts:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "g",
-				"format": "openai",
-				"family": "tts",
-				"families": ["tts"],
-				"parameter_size": "x",
-				"quantization_level": "d"
-			}
-		},
-		{
-			"name": "base64:latest",
-			"model": "base64:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "does",
-				"format": "openai (not really just have nothing to put here)",
-				"family": "base64",
-				"families": ["base64"],
-				"parameter_size": "it",
-				"quantization_level": "ever"
-			}
-		},
-		{
-			"name": "dall-e-3:latest",
-			"model": "dall-e-3:latest",
-			"modified_at": "2069-01-01T00:00:00Z",
-			"size": 69,
-			"digest": "yesiputfunnynumberabove",
-			"details": {
-				"parent_model": "stop",
-				"format": "openai",
-				"family": "dall-e-3",
-				"families": ["dall-e-3"],
-				"parameter_size": "finally",
-				"quantization_level": "!!!"
+// openAIText flattens openai message content (string or [{"type":"text","text":...}]) down to plain text
+func openAIText(content interface{}) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []interface{}:
+		var sb strings.Builder
+		for _, part := range c {
+			if p, ok := part.(map[string]interface{}); ok && p["type"] == "text" {
+				if t, ok := p["text"].(string); ok {
+					sb.WriteString(t)
+				}
 			}
 		}
-	]
-}`))
+		return sb.String()
+	}
+	return ""
 }
 
-// split words (just so the responses are the same as ollama)
-func SplitW(s string) []string {
-	var result []string
-	var current string
-	pendingSpace := false
+// hOpenAIChat is /v1/chat/completions for tools that only speak openai. the request gets turned into an ollama
+// /api/chat request and run through hChat so routing/limits/retries are all the same, openAIWriter translates back
+func hOpenAIChat(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "POST, OPTIONS")
 
-	for i, r := range s {
-		switch r {
-		case ' ':
-			if current != "" {
-				result = append(result, current)
-				current = ""
-			}
-			pendingSpace = true
-		case '\n', '\t':
-			if current != "" {
-				result = append(result, current)
-				current = ""
-			}
-			if r == '\n' {
-				result = append(result, "\n")
-			} else {
-				result = append(result, "\t")
-			}
-			pendingSpace = false
-		default:
-			if pendingSpace {
-				current = " " + string(r)
-				pendingSpace = false
-			} else {
-				current += string(r)
-			}
-		}
-		// appends it if this is the last rune and current isn't empty 🫠
-		if i == len(s)-1 && current != "" {
-			result = append(result, current)
-		}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	ow := &openAIWriter{real: w, header: http.Header{}, created: time.Now().Unix()}
+	ow.id = fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+	if r.Method != http.MethodPost {
+		ow.writeError(http.StatusMethodNotAllowed, "method not allowed")
+		return
 	}
-	return result
-}
 
-// basically just trims the tip of the message down if it's too long xd (apart of dementia mode)
-func circumsizeM(messages []msg, maxLength int) []msg {
-	if len(messages) == 0 {
-		return messages
+	var oreq openAIReq
+	if err := json.NewDecoder(r.Body).Decode(&oreq); err != nil {
+		ow.writeError(http.StatusBadRequest, "invalid json")
+		return
 	}
-	totalLength := 0
-	for _, m := range messages {
-		totalLength += len(m.Content)
+	if strings.TrimSpace(oreq.Model) == "" {
+		oreq.Model = conf().DefaultModel
 	}
-	if totalLength <= maxLength {
-		return messages
+	ow.stream, ow.model = oreq.Stream, oreq.Model
+
+	messages := make([]msg, 0, len(oreq.Messages))
+	for _, m := range oreq.Messages {
+		messages = append(messages, msg{Role: m.Role, Content: openAIText(m.Content)})
 	}
-	circumsized := make([]msg, 0, len(messages))
+	options := map[string]interface{}{}
+	if oreq.Temperature != nil {
+		options["temperature"] = *oreq.Temperature
+	}
+	if oreq.TopP != nil {
+		options["top_p"] = *oreq.TopP
+	}
+	if oreq.MaxTokens != nil {
+		options["max_tokens"] = *oreq.MaxTokens
+	}
+	if oreq.Seed != nil {
+		options["seed"] = *oreq.Seed
+	}
+	if oreq.Stop != nil {
+		options["stop"] = oreq.Stop
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":    oreq.Model,
+		"messages": messages,
+		"stream":   oreq.Stream,
+		"options":  options,
+	})
+
+	inner := r.Clone(context.WithValue(r.Context(), openAIRequestKey{}, true))
+	inner.URL.Path = "/api/chat"
+	inner.Header.Del("Accept") // openAIWriter wants ndjson from hChat, it does its own sse
+	inner.Body = io.NopCloser(bytes.NewReader(body))
+	inner.ContentLength = int64(len(body))
+	hChat(ow, inner)
+	ow.finish()
+}
+
+// openAIRequestKey marks the requests hChat gets from hOpenAIChat. openai clients pick stream themselves and get the
+// reply text exactly as the upstream sent it (the forced streaming and sanitizing are for ollama clients)
+type openAIRequestKey struct{}
+
+func isOpenAIRequest(ctx context.Context) bool {
+	v, _ := ctx.Value(openAIRequestKey{}).(bool)
+	return v
+}
+
+// openAIWriter sits between hChat and the client turning the ollama ndjson frames into openai chat.completion
+// objects (or chat.completion.chunk sse events when streaming). {"error": ...} replies get openai's error shape
+type openAIWriter struct {
+	real    http.ResponseWriter
+	header  http.Header // hChat's headers land here and get dropped, the real ones are set by us
+	stream  bool
+	id      string
+	model   string
+	created int64
+
+	status     int
+	started    bool // headers + the role chunk went out (streaming only)
+	pending    []byte
+	content    strings.Builder
+	finishSent bool
+	doneReason string
+	usage      *tokenUsage // from the final frame, only there with -report-usage
+}
+
+func (ow *openAIWriter) Header() http.Header { return ow.header }
+
+func (ow *openAIWriter) WriteHeader(status int) {
+	if ow.status == 0 {
+		ow.status = status
+	}
+}
+
+func (ow *openAIWriter) Write(p []byte) (int, error) {
+	if ow.status == 0 {
+		ow.status = http.StatusOK
+	}
+	ow.pending = append(ow.pending, p...)
+	if ow.status >= 400 {
+		return len(p), nil // error bodies get converted in finish
+	}
+	for {
+		i := bytes.IndexByte(ow.pending, '\n')
+		if i < 0 {
+			break
+		}
+		ow.frame(ow.pending[:i])
+		ow.pending = ow.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+func (ow *openAIWriter) Flush() {
+	if f, ok := ow.real.(http.Flusher); ok && ow.started {
+		f.Flush()
+	}
+}
+
+// frame handles one ollama ndjson line
+func (ow *openAIWriter) frame(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var f ollamaResp
+	if err := json.Unmarshal(line, &f); err != nil {
+		slog.Debug("skipping non json line for the openai reply", "err", err)
+		return
+	}
+	if f.Done {
+		ow.doneReason = f.DoneReason
+		ow.usage = f.Usage
+	}
+	if !ow.stream {
+		ow.content.WriteString(f.Message.Content)
+		return
+	}
+	if f.Message.Content != "" {
+		ow.chunk(map[string]interface{}{"content": f.Message.Content}, nil)
+	}
+	if f.Done {
+		ow.endStream()
+	}
+}
+
+// chunk writes one chat.completion.chunk sse event (the first one also carries the role like openai does)
+func (ow *openAIWriter) chunk(delta map[string]interface{}, finishReason interface{}) {
+	if !ow.started {
+		ow.started = true
+		h := ow.real.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Connection", "keep-alive")
+		h.Set("X-Accel-Buffering", "no")
+		ow.real.WriteHeader(http.StatusOK)
+		delta["role"] = "assistant"
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"id":      ow.id,
+		"object":  "chat.completion.chunk",
+		"created": ow.created,
+		"model":   ow.model,
+		"choices": []map[string]interface{}{{"index": 0, "delta": delta, "finish_reason": finishReason}},
+	})
+	ow.real.Write([]byte("data: "))
+	ow.real.Write(b)
+	ow.real.Write([]byte("\n\n"))
+	ow.Flush()
+}
+
+// endStream sends the finish_reason chunk and the [DONE] terminator
+func (ow *openAIWriter) endStream() {
+	if ow.finishSent {
+		return
+	}
+	ow.finishSent = true
+	ow.chunk(map[string]interface{}{}, openAIFinishReason(ow.doneReason))
+	ow.real.Write([]byte("data: [DONE]\n\n"))
+	ow.Flush()
+}
+
+// finish writes whatever hChat left over once it returned (the whole reply when not streaming)
+func (ow *openAIWriter) finish() {
+	if ow.status >= 400 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		message := strings.TrimSpace(string(ow.pending))
+		if json.Unmarshal(ow.pending, &e) == nil && e.Error != "" {
+			message = e.Error
+		}
+		ow.writeError(ow.status, message)
+		return
+	}
+	if len(ow.pending) > 0 {
+		ow.frame(ow.pending)
+		ow.pending = nil
+	}
+	if ow.stream {
+		ow.endStream()
+		return
+	}
+	completion := map[string]interface{}{
+		"id":      ow.id,
+		"object":  "chat.completion",
+		"created": ow.created,
+		"model":   ow.model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"message":       map[string]interface{}{"role": "assistant", "content": ow.content.String()},
+			"finish_reason": openAIFinishReason(ow.doneReason),
+		}},
+	}
+	if ow.usage != nil {
+		completion["usage"] = ow.usage
+	}
+	b, _ := json.Marshal(completion)
+	ow.real.Header().Set("Content-Type", "application/json")
+	ow.real.WriteHeader(http.StatusOK)
+	ow.real.Write(b)
+}
+
+// writeError answers in openai's error shape ({"error": {"message": ..., "type": ...}})
+func (ow *openAIWriter) writeError(status int, message string) {
+	errType := "api_error"
+	if status < 500 {
+		errType = "invalid_request_error"
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{"message": message, "type": errType},
+	})
+	ow.real.Header().Set("Content-Type", "application/json")
+	ow.real.WriteHeader(status)
+	ow.real.Write(b)
+}
+
+// openAIFinishReason maps ollama's done_reason onto openai's finish_reason
+func openAIFinishReason(doneReason string) string {
+	if doneReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// v1RolePrefix is the "User: " style label a message gets in the flat v1 messages list
+func v1RolePrefix(role string) string {
+	switch role {
+	case "system":
+		return "System: "
+	case "assistant":
+		return "Assistant: "
+	case "tool":
+		return "Tool: "
+	case "user", "":
+		return "User: "
+	}
+	return role + ": "
+}
+
+// acceptsImages reports if a routed model (see modelRoute) can take images in messages
+func acceptsImages(route string) bool {
+	switch route {
+	case "gpt-4o", "gpt-4o-mini", "gpt-4.1-nano", "gpt-4.1-mini", "gpt-4.1":
+		return true
+	}
+	return false
+}
+
+func hasImages(messages []msg) bool {
+	for _, m := range messages {
+		if len(m.Images) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// openAIContent is a message's content for the v2 endpoint: the plain string, or the multimodal
+// [{"type":"text"}, {"type":"image_url"}...] list when it carries images
+func openAIContent(m msg) interface{} {
+	if len(m.Images) == 0 {
+		return m.Content
+	}
+	parts := []map[string]interface{}{{"type": "text", "text": m.Content}}
+	for _, img := range m.Images {
+		parts = append(parts, map[string]interface{}{
+			"type":      "image_url",
+			"image_url": map[string]interface{}{"url": imageDataURI(img)},
+		})
+	}
+	return parts
+}
+
+// imageDataURI turns ollama's bare base64 image into a data uri (the type is sniffed from the bytes)
+func imageDataURI(img string) string {
+	if strings.HasPrefix(img, "data:") {
+		return img
+	}
+	mime := "image/png"
+	// 512 bytes is all DetectContentType looks at (684 base64 chars cover that)
+	head := img
+	if len(head) > 684 {
+		head = head[:684]
+	}
+	if b, err := base64.StdEncoding.DecodeString(head[:len(head)/4*4]); err == nil {
+		if sniffed := http.DetectContentType(b); strings.HasPrefix(sniffed, "image/") {
+			mime = sniffed
+		}
+	}
+	return "data:" + mime + ";base64," + img
+}
+
+// validBase64Format reports if f is one of the -base64-format / options.image_format styles
+func validBase64Format(f string) bool {
+	return f == "markdown" || f == "images" || f == "raw"
+}
+
+// base64ImageContent wraps the base64 model's output the way format asks for, images puts the bare base64 in the
+// message's images field (generate replies have no such field so they get markdown instead)
+func base64ImageContent(b64, format string, isGenerate bool) (string, []string) {
+	if b64 == "" {
+		return "", nil
+	}
+	switch {
+	case format == "raw":
+		return b64, nil
+	case format == "images" && !isGenerate:
+		if _, data, ok := strings.Cut(b64, ";base64,"); ok && strings.HasPrefix(b64, "data:") {
+			b64 = data
+		}
+		return "", []string{b64}
+	}
+	return "![generated](" + imageDataURI(b64) + ")", nil
+}
+
+// setCORS writes the cors headers every handler sends. with -cors-origin * anything goes, otherwise the request's
+// Origin is echoed back only when it's on the list (no header at all means the browser blocks it)
+func setCORS(w http.ResponseWriter, r *http.Request, methods string) {
+	origins := conf().corsOrigins
+	if origins["*"] {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && origins[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+}
+
+// guardError is what a failed guard wants the client to see. status 0 means an in-band ollama reply (so chat UIs just
+// show it), anything else is a real http error
+type guardError struct {
+	status  int
+	message string
+}
+
+func (g guardError) write(w http.ResponseWriter, model string, isGenerate bool) {
+	if g.status == 0 {
+		writeOllamaError(w, model, isGenerate, g.message)
+		return
+	}
+	writeJSONError(w, g.status, g.message)
+}
+
+// guardTaskSpam blocks the "### Task:" follow up/title requests chat UIs fire after every reply (see -block-task-spam)
+func guardTaskSpam(cfg *config, scope []msg) (bool, guardError) {
+	if !cfg.BlockTaskSpam || !isTaskSpam(scope) {
+		return true, guardError{}
+	}
+	slog.Debug("blocked request (unnecessary api spam)")
+	return false, guardError{message: "Request blocked due to unnecessary api spam (trying to predict next messages/chatname)"}
+}
+
+// guardLength checks a chat conversation against limit. over the limit it gets trimmed (dementia mode or
+// -on-overlength=trim), errors out (-on-overlength=error) or gets the apology message
+func guardLength(cfg *config, messages []msg, limit int) ([]msg, bool, guardError) {
+	totalLength := 0
+	for _, m := range messages {
+		totalLength += len(m.Content)
+	}
+	if totalLength <= limit {
+		return messages, true, guardError{}
+	}
+	if (dementiaOverride != nil && *dementiaOverride) || cfg.OnOverlength == "trim" {
+		slog.Debug("prompt too long using dementia mode to trim it down", "chars", totalLength, "limit", limit)
+		return circumsizeM(messages, limit, cfg.CharsPerToken), true, guardError{}
+	}
+	if cfg.OnOverlength == "error" {
+		slog.Debug("prompt too long returning an error", "chars", totalLength, "limit", limit)
+		return messages, false, guardError{status: http.StatusRequestEntityTooLarge, message: fmt.Sprintf("prompt too long (%d characters, limit is %d)", totalLength, limit)}
+	}
+	slog.Debug("prompt too long blocking request (use dementia mode if u want the messages to just be trimmed down)", "chars", totalLength, "limit", limit)
+	return messages, false, guardError{message: fmt.Sprintf("prompt too long please keep it under %d characters (or simply enable dementia mode next time on runtime)", limit)}
+}
+
+// guardPromptLength is guardLength for the single prompt image/tts models take (nothing to trim there so it always
+// blocks), what is named in the message ("image generation", "tts")
+func guardPromptLength(prompt string, limit int, what string) (bool, guardError) {
+	if len(prompt) <= limit {
+		return true, guardError{}
+	}
+	slog.Debug("prompt too long blocking request", "what", what, "chars", len(prompt), "limit", limit)
+	return false, guardError{message: fmt.Sprintf("please keep the text under %d characters (btw using %s in chat mode is not smart)", limit, what)}
+}
+
+// isChatRoute reports if a routed model (see modelRoute) is a text chat model and not an image/tts one
+func isChatRoute(route string) bool {
+	switch route {
+	case "dall-e-3", "base64", "tts":
+		return false
+	}
+	return true
+}
+
+// formatInstruction turns ollama's format field into the instruction the upstream gets, "" when no json was asked for
+// (format is either "json" or a json schema object)
+func formatInstruction(format interface{}) string {
+	switch f := format.(type) {
+	case string:
+		if f == "json" {
+			return "Respond with valid JSON only. No markdown code fences, no explanations, nothing before or after the JSON."
+		}
+	case map[string]interface{}:
+		schema, _ := json.Marshal(f)
+		return "Respond with valid JSON only, matching this JSON schema: " + string(schema) + ". No markdown code fences, no explanations, nothing before or after the JSON."
+	}
+	return ""
+}
+
+// withSystemInstruction adds instruction to the leading system message, or puts a new system message first
+func withSystemInstruction(messages []msg, instruction string) []msg {
+	out := make([]msg, 0, len(messages)+1)
+	if len(messages) > 0 && messages[0].Role == "system" {
+		first := messages[0]
+		first.Content = strings.TrimRight(first.Content, "\n") + "\n\n" + instruction
+		return append(append(out, first), messages[1:]...)
+	}
+	out = append(out, msg{Role: "system", Content: instruction})
+	return append(out, messages...)
+}
+
+// cleanJSONReply trims whitespace and a ```json fence (models love adding one) off reply and reports if what's left
+// parses as json
+func cleanJSONReply(reply string) (string, bool) {
+	cleaned := strings.TrimSpace(reply)
+	if strings.HasPrefix(cleaned, "```") && strings.HasSuffix(cleaned, "```") && len(cleaned) >= 6 {
+		cleaned = strings.TrimSuffix(cleaned[3:], "```")
+		cleaned = strings.TrimPrefix(cleaned, "json")
+		cleaned = strings.TrimSpace(cleaned)
+	}
+	if json.Valid([]byte(cleaned)) {
+		return cleaned, true
+	}
+	return reply, false
+}
+
+// baseModelName drops the tag ("gpt-4o:latest", "gpt-4o:8b" -> "gpt-4o") since routing only cares about the name
+func baseModelName(model string) string {
+	base, _, _ := strings.Cut(model, ":")
+	return base
+}
+
+// modelRoute maps a model name (without the tag) onto the model it actually gets served by, anything unknown ends up on gpt-3.5
+func modelRoute(baseModel string) string {
+	switch baseModel {
+	case "gpt-4o", "gpt-4o-mini", "gpt-4.1-nano", "gpt-4.1-mini", "gpt-4.1", "dall-e-3", "base64", "tts", "echo":
+		return baseModel
+	}
+	return "gpt-3.5"
+}
+
+// tagModel is one model entry in /api/tags
+type tagModel struct {
+	Name       string     `json:"name"`
+	Model      string     `json:"model"`
+	ModifiedAt string     `json:"modified_at"`
+	Size       int64      `json:"size"`
+	Digest     string     `json:"digest"`
+	Details    tagDetails `json:"details"`
+}
+
+// tagDetails is the details block of a tagModel
+type tagDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+	ContextLength     int      `json:"context_length,omitempty"` // tokens, worked out from -limits unless -models-file sets it
+}
+
+// defaultTagModels is the built in list of models /api/tags advertises
+// changed everything to add :latest since doesn't work without it 🫠
+var defaultTagModels = []tagModel{
+	{
+		Name:       "gpt-4o:latest",
+		Model:      "gpt-4o:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "fuck you",
+			Format:            "openai",
+			Family:            "gpt-4o",
+			Families:          []string{"gpt-4o"},
+			ParameterSize:     "yes",
+			QuantizationLevel: "i",
+		},
+	},
+	{
+		Name:       "gpt-4o-mini:latest",
+		Model:      "gpt-4o-mini:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "don't",
+			Format:            "openai",
+			Family:            "gpt-4o-mini",
+			Families:          []string{"gpt-4o-mini"},
+			ParameterSize:     "know",
+			QuantizationLevel: "what",
+		},
+	},
+	{
+		Name:       "gpt-4.1-nano:latest",
+		Model:      "gpt-4.1-nano:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "to",
+			Format:            "openai",
+			Family:            "gpt-4.1-nano",
+			Families:          []string{"gpt-4.1-nano"},
+			ParameterSize:     "put",
+			QuantizationLevel: "here",
+		},
+	},
+	{
+		Name:       "gpt-4.1-mini:latest",
+		Model:      "gpt-4.1-mini:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "so",
+			Format:            "fuck",
+			Family:            "gpt-4.1-mini",
+			Families:          []string{"gpt-4.1-mini"},
+			ParameterSize:     "off",
+			QuantizationLevel: ":)",
+		},
+	},
+	{
+		Name:       "gpt-4.1:latest",
+		Model:      "gpt-4.1:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "too",
+			Format:            "openai",
+			Family:            "gpt-4.1",
+			Families:          []string{"gpt-4.1"},
+			ParameterSize:     "many",
+			QuantizationLevel: "models",
+		},
+	},
+	{
+		Name:       "gpt-3.5:latest",
+		Model:      "gpt-3.5:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "i",
+			Format:            "openai",
+			Family:            "gpt-3.5",
+			Families:          []string{"gpt-3.5"},
+			ParameterSize:     "s",
+			QuantizationLevel: "t",
+		},
+	},
+	{
+		Name:       "tts:latest",
+		Model:      "tts:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "g",
+			Format:            "openai",
+			Family:            "tts",
+			Families:          []string{"tts"},
+			ParameterSize:     "x",
+			QuantizationLevel: "d",
+		},
+	},
+	{
+		Name:       "base64:latest",
+		Model:      "base64:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "does",
+			Format:            "openai (not really just have nothing to put here)",
+			Family:            "base64",
+			Families:          []string{"base64"},
+			ParameterSize:     "it",
+			QuantizationLevel: "ever",
+		},
+	},
+	{
+		Name:       "dall-e-3:latest",
+		Model:      "dall-e-3:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "stop",
+			Format:            "openai",
+			Family:            "dall-e-3",
+			Families:          []string{"dall-e-3"},
+			ParameterSize:     "finally",
+			QuantizationLevel: "!!!",
+		},
+	},
+	{
+		Name:       "echo:latest",
+		Model:      "echo:latest",
+		ModifiedAt: "2069-01-01T00:00:00Z",
+		Size:       69,
+		Digest:     "yesiputfunnynumberabove",
+		Details: tagDetails{
+			ParentModel:       "",
+			Format:            "none (never leaves the proxy)",
+			Family:            "echo",
+			Families:          []string{"echo"},
+			ParameterSize:     "0",
+			QuantizationLevel: "none",
+		},
+	},
+}
+
+// tagsJSON is the marshaled /api/tags body so it isn't rebuilt on every request, tagModels is the same list for
+// lookups (/api/show etc). tagsMu guards reloads
+var (
+	tagsMu    sync.RWMutex
+	tagsJSON  []byte
+	tagModels []tagModel
+)
+
+// modelAliases maps an alias base name to the base name of the model it routes to (set through /api/copy, -alias
+// ones live in the config), aliasMu guards it
+var (
+	aliasMu      sync.RWMutex
+	modelAliases = map[string]string{}
+)
+
+// resolveAlias gives the model an alias points at, or base itself when it isn't an alias (/api/copy ones win over -alias)
+func resolveAlias(base string) string {
+	aliasMu.RLock()
+	target, ok := modelAliases[base]
+	aliasMu.RUnlock()
+	if ok {
+		return target
+	}
+	if c := conf(); c != nil {
+		if target, ok := c.aliases[base]; ok {
+			return target
+		}
+	}
+	return base
+}
+
+// reloadTags marshals the model list once (minus disabled models) and swaps it in for hTags to serve
+func reloadTags(c *config) error {
+	source := defaultTagModels
+	if c != nil && c.ModelsFile != "" {
+		fromFile, err := loadModelsFile(c.ModelsFile)
+		if err != nil {
+			return err
+		}
+		source = fromFile
+	}
+	models := make([]tagModel, 0, len(source))
+	for _, m := range source {
+		if c == nil || !c.disabledModels[baseModelName(m.Name)] {
+			if m.Details.ContextLength == 0 {
+				m.Details.ContextLength = contextLength(c, modelRoute(baseModelName(m.Name)))
+			}
+			models = append(models, m)
+		}
+	}
+	// aliases show up as copies of the model they point at (skipped when that one is disabled or not listed)
+	aliases := map[string]string{}
+	if c != nil {
+		for alias, target := range c.aliases {
+			aliases[alias] = target
+		}
+	}
+	aliasMu.RLock()
+	for alias, target := range modelAliases {
+		aliases[alias] = target
+	}
+	aliasMu.RUnlock()
+	listed := len(models)
+	for _, alias := range sortedKeys(aliases) {
+		for _, m := range models[:listed] {
+			if baseModelName(m.Name) == aliases[alias] {
+				m.Name, m.Model = alias+":latest", alias+":latest"
+				models = append(models, m)
+				break
+			}
+		}
+	}
+	b, err := json.Marshal(struct {
+		Models []tagModel `json:"models"`
+	}{models})
+	if err != nil {
+		return err
+	}
+	tagsMu.Lock()
+	tagsJSON = b
+	tagModels = models
+	tagsMu.Unlock()
+	return nil
+}
+
+// loadModelsFile reads a model list either in the /api/tags shape ({"models": [...]}) or as a bare array
+func loadModelsFile(path string) ([]tagModel, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("-models-file: %w", err)
+	}
+	var wrapped struct {
+		Models []tagModel `json:"models"`
+	}
+	var models []tagModel
+	if err := json.Unmarshal(b, &wrapped); err == nil && wrapped.Models != nil {
+		models = wrapped.Models
+	} else if err := json.Unmarshal(b, &models); err != nil {
+		return nil, fmt.Errorf("-models-file %s: expected {\"models\": [...]} or a list of models: %w", path, err)
+	}
+	for i := range models {
+		if models[i].Name == "" {
+			return nil, fmt.Errorf("-models-file %s: model %d has no name", path, i)
+		}
+		if models[i].Model == "" {
+			models[i].Model = models[i].Name
+		}
+	}
+	return models, nil
+}
+
+// findTagModel looks a model up in the served list, "gpt-4o" matches any gpt-4o tag while "gpt-4o:latest" has to be exact
+func findTagModel(name string) (tagModel, bool) {
+	cachedTags() // makes sure the list got built
+	tagsMu.RLock()
+	defer tagsMu.RUnlock()
+	for _, m := range tagModels {
+		if m.Name == name || baseModelName(m.Name) == name {
+			return m, true
+		}
+	}
+	return tagModel{}, false
+}
+
+// cachedTags returns the marshaled tags building them lazily if nothing was loaded yet
+func cachedTags() []byte {
+	tagsMu.RLock()
+	b := tagsJSON
+	tagsMu.RUnlock()
+	if b == nil {
+		if err := reloadTags(conf()); err != nil {
+			return []byte(`{"models":[]}`)
+		}
+		tagsMu.RLock()
+		b = tagsJSON
+		tagsMu.RUnlock()
+	}
+	return b
+}
+
+// showResp is the response format for ollama show (api/show)
+type showResp struct {
+	Modelfile    string                 `json:"modelfile"`
+	Parameters   string                 `json:"parameters"`
+	Template     string                 `json:"template"`
+	Details      tagDetails             `json:"details"`
+	ModelInfo    map[string]interface{} `json:"model_info"`
+	Capabilities []string               `json:"capabilities"`
+	ModifiedAt   string                 `json:"modified_at"`
+}
+
+// model metadata for clients like open webui that ask before chatting (same list as /api/tags)
+func hShow(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// older clients send name newer ones send model
+	var showReq struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&showReq); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	name := showReq.Model
+	if name == "" {
+		name = showReq.Name
+	}
+	m, ok := findTagModel(name)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("model %q not found", name))
+		return
+	}
+
+	b, _ := json.Marshal(showResp{
+		Modelfile:  fmt.Sprintf("# virtual model proxied to %s\nFROM %s\nTEMPLATE {{ .Prompt }}\nPARAMETER temperature 0.7\nPARAMETER num_ctx %d\n", conf().Upstream, m.Name, m.Details.ContextLength),
+		Parameters: fmt.Sprintf("temperature 0.7\nnum_ctx %d", m.Details.ContextLength),
+		Template:   "{{ .Prompt }}",
+		Details:    m.Details,
+		ModelInfo: map[string]interface{}{
+			"general.architecture":               m.Details.Family,
+			"general.basename":                   m.Details.Family,
+			m.Details.Family + ".context_length": m.Details.ContextLength, // where ollama clients look for it
+		},
+		Capabilities: []string{"completion"},
+		ModifiedAt:   m.ModifiedAt,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// pullStatus is one line of ollama's pull progress stream
+type pullStatus struct {
+	Status    string `json:"status"`
+	Digest    string `json:"digest,omitempty"`
+	Total     int64  `json:"total,omitempty"`
+	Completed int64  `json:"completed,omitempty"`
+}
+
+// models are virtual so there's nothing to download, known ones "finish" pulling straight away for clients that
+// insist on pulling before chatting
+func hPull(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var pullReq struct {
+		Name   string `json:"name"`
+		Model  string `json:"model"`
+		Stream *bool  `json:"stream,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&pullReq); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	name := pullReq.Model
+	if name == "" {
+		name = pullReq.Name
+	}
+	m, ok := findTagModel(baseModelName(name))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("pull model manifest: model %q not found", name))
+		return
+	}
+
+	if pullReq.Stream != nil && !*pullReq.Stream {
+		b, _ := json.Marshal(pullStatus{Status: "success"})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range []pullStatus{
+		{Status: "pulling manifest"},
+		{Status: "pulling " + m.Digest, Digest: m.Digest, Total: m.Size, Completed: m.Size},
+		{Status: "verifying sha256 digest"},
+		{Status: "writing manifest"},
+		{Status: "success"},
+	} {
+		b, _ := json.Marshal(line)
+		w.Write(b)
+		w.Write([]byte("\n"))
+	}
+}
+
+// blobs are virtual too, so every digest "exists" (some clients check with HEAD /api/blobs/sha256:... first and give up
+// on a 404)
+func hBlobs(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "HEAD, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodHead {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	slog.Debug("blob check answered with 200", "digest", strings.TrimPrefix(r.URL.Path, "/api/blobs/"))
+	w.WriteHeader(http.StatusOK)
+}
+
+// copies a model under a new name, which really just registers an alias that routes to the source model (kept in
+// memory so it's gone after a restart)
+func hCopy(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !apiKeyAuthorized(w, r) {
+		return
+	}
+
+	var copyReq struct {
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&copyReq); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	if copyReq.Source == "" || copyReq.Destination == "" {
+		writeJSONError(w, http.StatusBadRequest, "source and destination are required")
+		return
+	}
+	source := resolveAlias(baseModelName(copyReq.Source))
+	if _, ok := findTagModel(source); !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("model %q not found", copyReq.Source))
+		return
+	}
+	dest := baseModelName(copyReq.Destination)
+	aliasMu.RLock()
+	_, isAlias := modelAliases[dest]
+	aliasMu.RUnlock()
+	if _, exists := findTagModel(dest); exists && !isAlias {
+		writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("model %q already exists", copyReq.Destination))
+		return
+	}
+
+	aliasMu.Lock()
+	modelAliases[dest] = source
+	aliasMu.Unlock()
+	if err := reloadTags(conf()); err != nil {
+		slog.Error("rebuilding the model list failed", "err", err)
+	}
+	slog.Info("model alias added", "alias", dest, "model", source)
+	w.WriteHeader(http.StatusOK)
+}
+
+// deletes an alias made with /api/copy. the real models (and -alias ones) can't go anywhere so deleting one just says ok
+func hDelete(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "DELETE, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !apiKeyAuthorized(w, r) {
+		return
+	}
+
+	var deleteReq struct {
+		Name  string `json:"name"`
+		Model string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&deleteReq); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	name := deleteReq.Model
+	if name == "" {
+		name = deleteReq.Name
+	}
+	base := baseModelName(name)
+	aliasMu.Lock()
+	_, isAlias := modelAliases[base]
+	delete(modelAliases, base)
+	aliasMu.Unlock()
+	if isAlias {
+		if err := reloadTags(conf()); err != nil {
+			slog.Error("rebuilding the model list failed", "err", err)
+		}
+		slog.Info("model alias removed", "alias", base)
+	} else if _, ok := findTagModel(base); !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("model %q not found", name))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// psKeepAlive is how long a model shows up in /api/ps after it was last used (same as ollama's default keep_alive)
+const psKeepAlive = 5 * time.Minute
+
+// lastUsed is when each routed model was last requested (only ever holds the handful of real models)
+var (
+	lastUsedMu sync.Mutex
+	lastUsed   = map[string]time.Time{}
+)
+
+func markModelUsed(route string) {
+	lastUsedMu.Lock()
+	lastUsed[route] = time.Now()
+	lastUsedMu.Unlock()
+}
+
+// psModel is one entry of /api/ps
+type psModel struct {
+	tagModel
+	ExpiresAt string `json:"expires_at"`
+	SizeVRAM  int64  `json:"size_vram"`
+}
+
+// pretends recently used models are "loaded" so dashboards polling running models don't show errors
+func hPs(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "GET, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	running := []psModel{}
+	lastUsedMu.Lock()
+	for route, at := range lastUsed {
+		if time.Since(at) > psKeepAlive {
+			continue
+		}
+		if m, ok := findTagModel(route); ok {
+			running = append(running, psModel{
+				tagModel:  m,
+				ExpiresAt: at.Add(psKeepAlive).UTC().Format(time.RFC3339),
+				SizeVRAM:  m.Size,
+			})
+		}
+	}
+	lastUsedMu.Unlock()
+	sort.Slice(running, func(i, j int) bool { return running[i].Name < running[j].Name })
+
+	b, _ := json.Marshal(struct {
+		Models []psModel `json:"models"`
+	}{running})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// errNoEmbeddings is returned when an embeddings request comes in but no -embeddings-url is set
+var errNoEmbeddings = errors.New("embeddings are not configured on this proxy (start it with -embeddings-url)")
+
+// fetchEmbeddings sends inputs to the embeddings upstream (openai format) and returns one vector per input in order
+func fetchEmbeddings(ctx context.Context, cfg *config, model string, inputs []string) ([][]float64, error) {
+	if cfg.EmbeddingsURL == "" {
+		return nil, errNoEmbeddings
+	}
+	reqBody, _ := json.Marshal(map[string]interface{}{
+		"model": model,
+		"input": inputs,
+	})
+	resp, body, err := postWithTimeout(ctx, cfg.ChatTimeout, cfg.EmbeddingsURL, "application/json", nil, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings upstream returned status %d", resp.StatusCode)
+	}
+	var embResp struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &embResp); err != nil {
+		return nil, fmt.Errorf("parsing embeddings response: %w", err)
+	}
+	if len(embResp.Data) != len(inputs) {
+		return nil, fmt.Errorf("embeddings upstream returned %d vectors for %d inputs", len(embResp.Data), len(inputs))
+	}
+	vectors := make([][]float64, len(inputs))
+	for i, d := range embResp.Data {
+		idx := d.Index
+		if idx < 0 || idx >= len(vectors) {
+			idx = i
+		}
+		vectors[idx] = d.Embedding
+	}
+	return vectors, nil
+}
+
+// old style ollama embeddings (one prompt in one vector out) for rag tools
+func hEmbeddings(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !apiKeyAuthorized(w, r) {
+		return
+	}
+
+	var embReq struct {
+		Model  string `json:"model"`
+		Prompt string `json:"prompt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&embReq); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	vectors, err := fetchEmbeddings(r.Context(), conf(), embReq.Model, []string{embReq.Prompt})
+	if err == errNoEmbeddings {
+		writeJSONError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("embeddings failed", "err", err)
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{"embedding": vectors[0]})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// new style ollama embeddings, input is a string or a list of them and every one gets a vector back in one call
+func hEmbed(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "POST, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !apiKeyAuthorized(w, r) {
+		return
+	}
+
+	var embReq struct {
+		Model string      `json:"model"`
+		Input interface{} `json:"input"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&embReq); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid json")
+		return
+	}
+	var inputs []string
+	switch in := embReq.Input.(type) {
+	case string:
+		inputs = []string{in}
+	case []interface{}:
+		for _, v := range in {
+			s, ok := v.(string)
+			if !ok {
+				writeJSONError(w, http.StatusBadRequest, "input must be a string or a list of strings")
+				return
+			}
+			inputs = append(inputs, s)
+		}
+	default:
+		writeJSONError(w, http.StatusBadRequest, "input must be a string or a list of strings")
+		return
+	}
+	if len(inputs) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "input is empty")
+		return
+	}
+	vectors, err := fetchEmbeddings(r.Context(), conf(), embReq.Model, inputs)
+	if err == errNoEmbeddings {
+		writeJSONError(w, http.StatusNotImplemented, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("embeddings failed", "err", err)
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{"model": embReq.Model, "embeddings": vectors})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// statusWriter remembers the status code a handler wrote (still flushable so streaming keeps working)
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// replyCacheEntry is one cached chat reply
+type replyCacheEntry struct {
+	key        string
+	reply      string
+	upstreamMs int64
+	expires    time.Time
+}
+
+// lruCache is the -cache-ttl reply cache, a map for lookups plus a list ordered by last use for eviction
+type lruCache struct {
+	mu    sync.Mutex
+	order *list.List // front = most recently used, values are *replyCacheEntry
+	items map[string]*list.Element
+}
+
+var replyCache = &lruCache{order: list.New(), items: map[string]*list.Element{}}
+
+// replyCacheKey hashes what gets sent upstream so huge prompts don't end up as map keys
+func replyCacheKey(endpoint string, reqBody []byte) string {
+	h := sha256.New()
+	h.Write([]byte(endpoint))
+	h.Write([]byte{0})
+	h.Write(reqBody)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns a live entry (expired ones get dropped on the way)
+func (c *lruCache) get(key string) (replyCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return replyCacheEntry{}, false
+	}
+	e := el.Value.(*replyCacheEntry)
+	if time.Now().After(e.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return replyCacheEntry{}, false
+	}
+	c.order.MoveToFront(el)
+	return *e, true
+}
+
+// put stores a reply for ttl, dropping the least recently used entries past max
+func (c *lruCache) put(key, reply string, upstreamMs int64, ttl time.Duration, max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &replyCacheEntry{key: key, reply: reply, upstreamMs: upstreamMs, expires: time.Now().Add(ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+	} else {
+		c.items[key] = c.order.PushFront(e)
+	}
+	for c.order.Len() > max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*replyCacheEntry).key)
+	}
+}
+
+// statsWindow is how many of the most recent requests the latency numbers are worked out from
+const statsWindow = 1000
+
+// requestStats is the in memory data behind /admin/stats. per model counts are keyed by the routed model so the
+// maps can't grow past the handful of real models and latencies live in a fixed size ring buffer
+type requestStats struct {
+	mu          sync.Mutex
+	total       int64
+	perModel    map[string]int64
+	errors      map[string]int64
+	latencies   [statsWindow]time.Duration
+	next        int
+	filled      int
+	cacheHits   int64
+	cacheMisses int64
+}
+
+var stats = &requestStats{perModel: map[string]int64{}, errors: map[string]int64{}}
+
+// record counts one finished request (errClass "" means it went fine)
+func (s *requestStats) record(model string, latency time.Duration, errClass string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total++
+	s.perModel[model]++
+	if errClass != "" {
+		s.errors[errClass]++
+	}
+	s.latencies[s.next] = latency
+	s.next = (s.next + 1) % statsWindow
+	if s.filled < statsWindow {
+		s.filled++
+	}
+}
+
+// cacheLookup counts a response cache hit or miss
+func (s *requestStats) cacheLookup(hit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hit {
+		s.cacheHits++
+	} else {
+		s.cacheMisses++
+	}
+}
+
+// statsSnapshot is the /admin/stats response
+type statsSnapshot struct {
+	TotalRequests int64            `json:"total_requests"`
+	PerModel      map[string]int64 `json:"per_model"`
+	Errors        map[string]int64 `json:"errors"`
+	Window        int              `json:"latency_window"`
+	AvgMs         float64          `json:"avg_ms"`
+	P50Ms         float64          `json:"p50_ms"`
+	P95Ms         float64          `json:"p95_ms"`
+	P99Ms         float64          `json:"p99_ms"`
+	CacheHitRate  float64          `json:"cache_hit_rate"`
+}
+
+func (s *requestStats) snapshot() statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := statsSnapshot{
+		TotalRequests: s.total,
+		PerModel:      make(map[string]int64, len(s.perModel)),
+		Errors:        make(map[string]int64, len(s.errors)),
+		Window:        s.filled,
+	}
+	for k, v := range s.perModel {
+		snap.PerModel[k] = v
+	}
+	for k, v := range s.errors {
+		snap.Errors[k] = v
+	}
+	if s.cacheHits+s.cacheMisses > 0 {
+		snap.CacheHitRate = float64(s.cacheHits) / float64(s.cacheHits+s.cacheMisses)
+	}
+	if s.filled == 0 {
+		return snap
+	}
+	sorted := make([]time.Duration, s.filled)
+	copy(sorted, s.latencies[:s.filled])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var sum time.Duration
+	for _, d := range sorted {
+		sum += d
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	pct := func(p float64) float64 { return ms(sorted[int(p*float64(len(sorted)-1))]) }
+	snap.AvgMs = ms(sum / time.Duration(len(sorted)))
+	snap.P50Ms, snap.P95Ms, snap.P99Ms = pct(0.50), pct(0.95), pct(0.99)
+	return snap
+}
+
+// upstreamBuckets are the upstream latency histogram bounds in seconds (image models take up to minutes)
+var upstreamBuckets = []float64{0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// promMetrics is the data behind /metrics, on its own registry so only these series show up. labels are the routed
+// model and the upstreamFailure classes so the series count stays small
+type promMetrics struct {
+	registry       *prometheus.Registry
+	requests       *prometheus.CounterVec
+	upstreamTimes  *prometheus.HistogramVec
+	upstreamErrors *prometheus.CounterVec
+	blocked        prometheus.Counter
+}
+
+func newPromMetrics() *promMetrics {
+	m := &promMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ollamagpt_requests_total",
+			Help: "Chat and generate requests handled, by model.",
+		}, []string{"model"}),
+		upstreamTimes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ollamagpt_upstream_duration_seconds",
+			Help:    "Time spent waiting on the upstream (retries included), by model.",
+			Buckets: upstreamBuckets,
+		}, []string{"model"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ollamagpt_upstream_errors_total",
+			Help: "Failed upstream calls by class (429 ratelimits, html cloudflare blocks, 5xx, empty, network).",
+		}, []string{"class"}),
+		blocked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ollamagpt_blocked_total",
+			Help: "Requests answered without asking the upstream (task spam, prompt over the limit).",
+		}),
+	}
+	m.registry.MustRegister(m.requests, m.upstreamTimes, m.upstreamErrors, m.blocked)
+	return m
+}
+
+var metrics = newPromMetrics()
+
+// request counts one finished chat/generate request for model, blocked ones never reached the upstream (task spam,
+// over the limit)
+func (m *promMetrics) request(model string, blocked bool) {
+	m.requests.WithLabelValues(model).Inc()
+	if blocked {
+		m.blocked.Inc()
+	}
+}
+
+// upstream records one upstream call: its latency and, when it failed, the failure class (429, html, 5xx...)
+func (m *promMetrics) upstream(model string, took time.Duration, errClass string) {
+	m.upstreamTimes.WithLabelValues(model).Observe(took.Seconds())
+	if errClass != "" {
+		m.upstreamErrors.WithLabelValues(errClass).Inc()
+	}
+}
+
+// sortedKeys returns a map's keys in order so /metrics output is stable between scrapes
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// prometheus scrape endpoint, public like /healthz since it only has counts per model in it
+func hMetrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// apiKeyAuthorized checks the -api-key bearer token on endpoints that burn upstream quota and writes the 401 itself
+// when it fails (no key configured means everyone's allowed)
+func apiKeyAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	key := conf().APIKey
+	if key == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(key)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
+
+// adminAuthorized checks the bearer token for /admin endpoints and writes the error itself when it fails
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := conf().AdminToken
+	if token == "" {
+		writeJSONError(w, http.StatusNotFound, "admin endpoints are disabled (set -admin-token)")
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+		return false
+	}
+	return true
+}
+
+// quick ops view of what the proxy has been up to (no prometheus needed)
+func hStats(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	b, _ := json.Marshal(stats.snapshot())
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// spoofs which models are available allowing services to see all your options.
+func hTags(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "GET, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(cachedTags())
+}
+
+// retryClasses are the upstream failure classes -retry-on can pick from
+var retryClasses = map[string]bool{"429": true, "html": true, "5xx": true, "empty": true, "network": true}
+
+// isHTMLBlock reports if the upstream handed back an html page (cloudflare or some other protection blocked us)
+func isHTMLBlock(body []byte) bool {
+	return strings.HasPrefix(string(body), `{"reply":"<!DOCTYPE html>\`) || strings.HasPrefix(string(body), "<html>")
+}
+
+// isRateLimited reports if the upstream said too many requests (either with the status or in the body)
+func isRateLimited(status int, body []byte) bool {
+	return status == 429 || strings.Contains(string(body), "\"Too many requests (\"")
+}
+
+// upstreamFailure sorts an upstream answer into one of retryClasses ("" means it looks fine)
+func upstreamFailure(status int, body []byte, err error, isChat bool) string {
+	switch {
+	case err != nil:
+		return "network"
+	case isRateLimited(status, body):
+		return "429"
+	case isHTMLBlock(body):
+		return "html"
+	case status >= 500:
+		return "5xx"
+	case len(bytes.TrimSpace(body)) == 0:
+		return "empty"
+	}
+	if isChat {
+		// valid json with nothing in it counts as empty too
+		var l streamLine
+		if json.Unmarshal(body, &l) == nil && l.Reply == "" && l.Content == "" && len(l.Choices) == 0 {
+			return "empty"
+		}
+	}
+	return ""
+}
+
+// doUpstream posts to the upstream and reads the whole reply, retrying the failure classes picked with -retry-on up to
+// -retries times with exponential backoff. whatever the last attempt got is returned (the body is already closed)
+func doUpstream(ctx context.Context, cfg *config, endpoint, contentType string, reqBody []byte, isChat bool, timeout time.Duration) (*http.Response, []byte, error) {
+	var resp *http.Response
+	var body []byte
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, body, err = postWithTimeout(ctx, timeout, endpoint, contentType, cfg.upstreamHeader, reqBody)
+		if err == nil && resp.StatusCode < 500 {
+			upstreamLastSeen.Store(time.Now().UnixNano())
+		}
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		class := upstreamFailure(status, body, err, isChat)
+		if class == "" || !cfg.retryOn[class] || attempt >= cfg.Retries {
+			return resp, body, err
+		}
+		delay := cfg.RetryDelay << attempt
+		// a 429 that says how long to back off knows better than our exponential guess
+		if wait, ok := retryAfter(resp, time.Now()); ok && class == "429" {
+			if wait > maxRetryAfter {
+				slog.Warn("upstream wants us to wait too long, not retrying", "retry_after", wait)
+				return resp, body, err
+			}
+			delay = wait
+		}
+		slog.Warn("upstream failed retrying", "class", class, "delay", delay, "attempt", attempt+1, "retries", cfg.Retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return resp, body, ctx.Err() // client is gone, no point retrying for nobody
+		}
+	}
+}
+
+// maxRetryAfter is the longest Retry-After doUpstream sleeps through, anything longer goes straight back to the client
+const maxRetryAfter = 30 * time.Second
+
+// retryAfter reads a response's Retry-After header, either delay seconds or an http date
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true // already in the past, go right away
+	}
+	return 0, false
+}
+
+// lastGoodUpstream is the base url that last answered properly, it gets tried first (empty until something answers)
+var lastGoodUpstream atomic.Value
+
+// upstreamOrder is the configured upstreams with the last good one moved to the front
+func upstreamOrder(upstreams []string) []string {
+	good, _ := lastGoodUpstream.Load().(string)
+	order := make([]string, 0, len(upstreams))
+	for _, u := range upstreams {
+		if u == good {
+			order = append(order, u)
+		}
+	}
+	for _, u := range upstreams {
+		if u != good {
+			order = append(order, u)
+		}
+	}
+	return order
+}
+
+// doUpstreams runs doUpstream against every upstream base in turn until one gives a real answer (no network error,
+// cloudflare page or 5xx), returns the last attempt's result if none did and the base it came from
+func doUpstreams(ctx context.Context, cfg *config, path, contentType string, reqBody []byte, isChat bool, timeout time.Duration) (*http.Response, []byte, string, error) {
+	var resp *http.Response
+	var body []byte
+	var err error
+	var base string
+	for _, base = range upstreamOrder(cfg.upstreams) {
+		resp, body, err = doUpstream(ctx, cfg, base+path, contentType, reqBody, isChat, timeout)
+		if err == nil && resp.StatusCode < 500 && !isHTMLBlock(body) {
+			lastGoodUpstream.Store(base)
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if len(cfg.upstreams) > 1 {
+			slog.Warn("upstream is down, trying the next one", "upstream", base, "err", err)
+		}
+	}
+	return resp, body, base, err
+}
+
+// postWithTimeout posts body (plus any extra headers) and reads the whole reply, giving up after timeout or when ctx
+// (usually the client's request) is done. the body is closed before returning
+func postWithTimeout(ctx context.Context, timeout time.Duration, url, contentType string, header http.Header, body []byte) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	// fresh reader every call so retries don't send a drained body
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := sharedHTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp, respBody, err
+	}
+	return resp, gunzipBody(resp, respBody), nil
+}
+
+// gunzipBody unpacks a gzip body the transport didn't already (it only does that when it asked for gzip itself, a
+// cloudflare page can still show up compressed). anything that isn't valid gzip comes back untouched
+func gunzipBody(resp *http.Response, body []byte) []byte {
+	if resp.Uncompressed {
+		return body
+	}
+	gzipped := strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip")
+	if !gzipped && !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		return body
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		slog.Debug("upstream body looked gzipped but isn't", "err", err)
+		return body
+	}
+	defer zr.Close()
+	plain, err := io.ReadAll(zr)
+	if err != nil {
+		slog.Debug("couldn't gunzip the upstream body", "err", err)
+		return body
+	}
+	resp.Header.Del("Content-Encoding")
+	return plain
+}
+
+// errFileTooLarge is what downloadAsset returns when a generated file goes over -max-download-size
+var errFileTooLarge = errors.New("generated file too large")
+
+// downloadAsset fetches a generated file (image/audio url from the upstream) but never buffers more than limit bytes
+// so an unexpectedly huge asset can't eat all the memory. returns the bytes and their content type
+func downloadAsset(ctx context.Context, url string, limit int64, timeout time.Duration) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := sharedHTTPClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("downloading %s: status %d", url, resp.StatusCode)
+	}
+	if resp.ContentLength > limit {
+		return nil, "", errFileTooLarge
+	}
+	// read one byte past the limit so going over can be told apart from landing exactly on it
+	b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(b)) > limit {
+		return nil, "", errFileTooLarge
+	}
+	return b, resp.Header.Get("Content-Type"), nil
+}
+
+// spoofs the ollama version since some clients refuse to connect without it
+func hVersion(w http.ResponseWriter, r *http.Request) {
+	setCORS(w, r, "GET, OPTIONS")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	b, _ := json.Marshal(map[string]string{"version": conf().OllamaVersion})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// upstreamLastSeen is when the upstream last gave a non 5xx answer (unix nanos, 0 = never)
+var upstreamLastSeen atomic.Int64
+
+// healthFresh is how recent an upstream answer has to be for /healthz to skip pinging it
+const healthFresh = time.Minute
+
+// readiness check (unlike "/" which always says ollama is running): 200 when the upstream answered within the last
+// minute (pinging it with a HEAD if nothing went through lately), 503 when it can't be reached
+func hHealth(w http.ResponseWriter, r *http.Request) {
+	cfg := conf()
+	status := http.StatusOK
+	last := time.Unix(0, upstreamLastSeen.Load())
+	if time.Since(last) > healthFresh {
+		status = http.StatusServiceUnavailable
+		for _, base := range upstreamOrder(cfg.upstreams) {
+			if err := pingUpstream(r.Context(), base, cfg.upstreamHeader); err != nil {
+				slog.Warn("health check can't reach the upstream", "upstream", base, "err", err)
+				continue
+			}
+			upstreamLastSeen.Store(time.Now().UnixNano())
+			status = http.StatusOK
+			break
+		}
+	}
+	result := map[string]interface{}{"status": "ok", "upstream": cfg.Upstream}
+	if len(cfg.upstreams) > 1 {
+		result["upstreams"] = cfg.upstreams
+	}
+	if status != http.StatusOK {
+		result["status"] = "upstream unreachable"
+	}
+	if seen := upstreamLastSeen.Load(); seen > 0 {
+		result["upstream_last_seen"] = time.Unix(0, seen).UTC().Format(time.RFC3339)
+	}
+	b, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// pingUpstream sends a HEAD to base (with the -upstream-header headers), anything below 500 counts as up
+func pingUpstream(ctx context.Context, base string, header http.Header) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, base, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := sharedHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// upstreamStreamed reports if the upstream answered with a stream (ndjson or sse) instead of one json object
+func upstreamStreamed(contentType string) bool {
+	return strings.Contains(contentType, "ndjson") || strings.Contains(contentType, "text/event-stream")
+}
+
+// streamLine is every shape a streamed upstream line has been seen in (v1 reply, v2 content, openai style deltas)
+type streamLine struct {
+	Reply   string `json:"reply"`
+	Content string `json:"content"`
+	Ms      int64  `json:"ms"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+// parseChatReply pulls the reply text and upstream ms out of a v1/v2 chat response, whatever shape it came in.
+// the string is the error message for the client when the body can't be read
+func parseChatReply(resp *http.Response, body []byte, isV2 bool) (string, int64, string) {
+	if upstreamStreamed(resp.Header.Get("Content-Type")) {
+		// upstream decided to stream at us so go line by line (bad lines get skipped instead of killing the whole reply)
+		reply, ms := parseStreamedReply(body)
+		return reply, ms, ""
+	}
+	if isV2 {
+		var v2 struct {
+			Content string `json:"content"`
+			Ms      int64  `json:"ms"`
+		}
+		if err := json.Unmarshal(body, &v2); err != nil {
+			return "", 0, "[ERROR] parsing v2 response..."
+		}
+		return v2.Content, v2.Ms, ""
+	}
+	var uhhchatresp chatResp
+	if err := json.Unmarshal(body, &uhhchatresp); err != nil {
+		return "", 0, "[ERROR] parsing response..."
+	}
+	return uhhchatresp.Reply, uhhchatresp.Ms, ""
+}
+
+// parseStreamedReply stitches the deltas of a streamed upstream body back together
+// malformed or partial lines are skipped (and logged in debug) so one flaky line doesn't throw away the rest of the reply
+func parseStreamedReply(body []byte) (string, int64) {
+	var sb strings.Builder
+	var ms int64
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		line = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if line == "" || line == "[DONE]" {
+			continue
+		}
+		var l streamLine
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			debugContent(conf(), fmt.Sprintf("skipping bad upstream stream line (%v)", err), line)
+			continue
+		}
+		sb.WriteString(l.Reply)
+		sb.WriteString(l.Content)
+		for _, c := range l.Choices {
+			sb.WriteString(c.Delta.Content)
+		}
+		if l.Ms > ms {
+			ms = l.Ms
+		}
+	}
+	return sb.String(), ms
+}
+
+// split words (just so the responses are the same as ollama)
+// spaces stick to the front of the word after them and \n / \t are their own tokens, joining the result gives back s exactly
+func SplitW(s string) []string {
+	var result []string
+	start := 0
+	inWord := false
+
+	for i, r := range s {
+		switch r {
+		case ' ':
+			if inWord {
+				result = append(result, s[start:i])
+				start = i
+				inWord = false
+			}
+		case '\n', '\t':
+			if i > start {
+				result = append(result, s[start:i])
+			}
+			result = append(result, string(r))
+			start = i + 1
+			inWord = false
+		default:
+			inWord = true
+		}
+	}
+	// whatever is left over (last word or trailing spaces) 🫠
+	if start < len(s) {
+		result = append(result, s[start:])
+	}
+	return result
+}
+
+// batchTokens groups SplitW tokens into chunks of at least size runes (counted in runes not bytes so cjk/emoji
+// heavy replies don't turn into one rune per frame) without ever cutting a token in half
+func batchTokens(s string, size int) []string {
+	var chunks []string
+	var batch strings.Builder
+	batchRunes := 0
+	for _, tok := range SplitW(s) {
+		batch.WriteString(tok)
+		batchRunes += utf8.RuneCountInString(tok)
+		if batchRunes >= size {
+			chunks = append(chunks, batch.String())
+			batch.Reset()
+			batchRunes = 0
+		}
+	}
+	if batch.Len() > 0 {
+		chunks = append(chunks, batch.String())
+	}
+	return chunks
+}
+
+// basically just trims the tip of the message down if it's too long xd (apart of dementia mode)
+// maxLength is in characters but messages get measured in estimated tokens (runes / charsPerToken) so multi byte text
+// isn't overcounted, charsPerToken <= 0 falls back to plain byte counting
+func circumsizeM(messages []msg, maxLength int, charsPerToken float64) []msg {
+	if len(messages) == 0 {
+		return messages
+	}
+	maxLength = tokenBudget(maxLength, charsPerToken)
+	totalLength := 0
+	for _, m := range messages {
+		totalLength += estimateTokens(m.Content, charsPerToken)
+	}
+	if totalLength <= maxLength {
+		return messages
+	}
+	circumsized := make([]msg, 0, len(messages))
 	systemMessages := make([]msg, 0)
-	for _, m := range messages {
+	lastUser := -1
+	for i, m := range messages {
 		if m.Role == "system" {
 			systemMessages = append(systemMessages, m)
+		} else if m.Role == "user" {
+			lastUser = i
 		}
 	}
 
+	// the newest user message always makes it (cut down to its tail if it alone is over budget) otherwise the
+	// actual question gets dropped and the reply makes no sense
+	keep := make([]bool, len(messages))
 	currentLength := 0
+	var latest msg
+	if lastUser >= 0 {
+		latest = messages[lastUser]
+		if estimateTokens(latest.Content, charsPerToken) > maxLength {
+			latest.Content = keepLastTokens(latest.Content, maxLength, charsPerToken)
+		}
+		keep[lastUser] = true
+		currentLength = estimateTokens(latest.Content, charsPerToken)
+	}
+
 	for i := len(messages) - 1; i >= 0; i-- {
-		if messages[i].Role == "system" {
+		if messages[i].Role == "system" || i == lastUser {
 			continue // Skip important instructions cuz u don't want it being clueless on how to behave
 		}
 
-		if currentLength+len(messages[i].Content) <= maxLength {
-			circumsized = append([]msg{messages[i]}, circumsized...)
-			currentLength += len(messages[i].Content)
+		// one oversized message doesn't end it, smaller older ones that still fit get packed in around it
+		cost := estimateTokens(messages[i].Content, charsPerToken)
+		if currentLength+cost > maxLength {
+			continue
+		}
+		keep[i] = true
+		currentLength += cost
+	}
+	for i, m := range messages {
+		if !keep[i] {
+			continue
+		}
+		if i == lastUser {
+			m = latest
+		}
+		circumsized = append(circumsized, m)
+	}
+
+	// every system message survives and they all go before the kept conversation (built into a fresh slice so the
+	// order can't get mixed up by append reusing systemMessages)
+	result := make([]msg, 0, len(systemMessages)+len(circumsized))
+	result = append(result, systemMessages...)
+	result = append(result, circumsized...)
+	slog.Debug("prompt circumsized", "from_tokens", totalLength, "to_tokens", currentLength)
+
+	return result
+}
+
+// estimateTokens is a rough token count (runes / charsPerToken rounded up), charsPerToken <= 0 just counts bytes
+func estimateTokens(s string, charsPerToken float64) int {
+	if charsPerToken <= 0 {
+		return len(s)
+	}
+	return int(math.Ceil(float64(utf8.RuneCountInString(s)) / charsPerToken))
+}
+
+// keepLastTokens cuts s down to roughly the last maxTokens tokens (whole runes only)
+func keepLastTokens(s string, maxTokens int, charsPerToken float64) string {
+	if charsPerToken <= 0 {
+		if len(s) <= maxTokens {
+			return s
+		}
+		start := len(s) - maxTokens
+		for start < len(s) && !utf8.RuneStart(s[start]) {
+			start++
+		}
+		return s[start:]
+	}
+	runes := []rune(s)
+	keep := int(float64(maxTokens) * charsPerToken)
+	if keep >= len(runes) {
+		return s
+	}
+	return string(runes[len(runes)-keep:])
+}
+
+// tokenBudget turns a character limit into the same unit estimateTokens counts in
+func tokenBudget(maxChars int, charsPerToken float64) int {
+	if charsPerToken <= 0 {
+		return maxChars
+	}
+	return int(float64(maxChars) / charsPerToken)
+}
+
+// reqTiming tracks where a request spent its time so a slow upstream can be told apart from a slow client
+type reqTiming struct {
+	start        time.Time
+	parsed       time.Time // request decoded and the upstream body built
+	upstreamDone time.Time // upstream reply fully read
+}
+
+// summary formats the breakdown as parse=Xms upstream=Yms stream=Zms total=Wms (steps that never happened show 0)
+func (t reqTiming) summary(end time.Time) string {
+	var parse, upstream, stream time.Duration
+	if t.parsed.IsZero() {
+		parse = end.Sub(t.start) // blocked or rejected before reaching upstream
+	} else {
+		parse = t.parsed.Sub(t.start)
+		if t.upstreamDone.IsZero() {
+			upstream = end.Sub(t.parsed)
+		} else {
+			upstream = t.upstreamDone.Sub(t.parsed)
+			stream = end.Sub(t.upstreamDone)
+		}
+	}
+	return fmt.Sprintf("parse=%dms upstream=%dms stream=%dms total=%dms", parse.Milliseconds(), upstream.Milliseconds(), stream.Milliseconds(), end.Sub(t.start).Milliseconds())
+}
+
+// doneMetrics are the ollama duration (ns) and count fields of the final frame
+type doneMetrics struct {
+	total, load, promptEval, eval int64
+	promptCount, evalCount        int
+}
+
+// tokenUsage is openai's usage object (the same estimated counts as prompt_eval_count/eval_count)
+type tokenUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// usage gives the counts as a tokenUsage when -report-usage is on, nil otherwise (so omitempty drops it)
+func (m doneMetrics) usage(cfg *config) *tokenUsage {
+	if !cfg.ReportUsage {
+		return nil
+	}
+	return &tokenUsage{PromptTokens: m.promptCount, CompletionTokens: m.evalCount, TotalTokens: m.promptCount + m.evalCount}
+}
+
+// metrics works out the final frame numbers from what actually happened: load is the request parsing, eval is the
+// upstream reported ms (or the whole upstream round trip when it didn't report one) and prompt eval is the rest of
+// the round trip. counts are estimated tokens since the upstream doesn't give any
+func (t reqTiming) metrics(end time.Time, upstreamMs int64, messages []msg, reply string, charsPerToken float64) doneMetrics {
+	if charsPerToken <= 0 {
+		charsPerToken = 4 // 0 means "trim by bytes" which is a terrible token count
+	}
+	m := doneMetrics{
+		total:     end.Sub(t.start).Nanoseconds(),
+		evalCount: estimateTokens(reply, charsPerToken),
+	}
+	for _, pm := range messages {
+		m.promptCount += estimateTokens(pm.Content, charsPerToken)
+	}
+	if t.parsed.IsZero() || t.upstreamDone.IsZero() {
+		return m
+	}
+	m.load = t.parsed.Sub(t.start).Nanoseconds()
+	roundTrip := t.upstreamDone.Sub(t.parsed).Nanoseconds()
+	m.eval = roundTrip
+	if reported := (time.Duration(upstreamMs) * time.Millisecond).Nanoseconds(); reported > 0 && reported < roundTrip {
+		m.eval = reported
+	}
+	m.promptEval = roundTrip - m.eval
+	return m
+}
+
+// splitSet turns "a, b,c" into a set (empty entries are ignored)
+func splitSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// isTaskSpam reports if any of messages is one of open webui's background task prompts (title, tags, follow ups...)
+func isTaskSpam(messages []msg) bool {
+	for _, m := range messages {
+		if strings.Contains(m.Content, "### Task:") {
+			return true
+		}
+	}
+	return false
+}
+
+// taskScanScope picks the messages the "### Task:" check looks at. task templates always come in the current request so
+// by default only the newest user message counts, otherwise one old task-like message blocks a conversation forever
+func taskScanScope(cfg *config, messages []msg) []msg {
+	if cfg.TaskScope == "all" {
+		return messages
+	}
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[i : i+1]
+		}
+	}
+	if len(messages) > 0 {
+		return messages[len(messages)-1:]
+	}
+	return nil
+}
+
+// debugContent is the only place prompt/reply text gets logged so -no-content-logs can promise it never reaches the console
+func debugContent(cfg *config, label, content string) {
+	if cfg.NoContentLogs {
+		slog.Debug(label, "bytes", len(content), "content", "<hidden>")
+		return
+	}
+	slog.Debug(label, "content", content)
+}
+
+// imageSizes are the sizes dall-e-3 can do (square, landscape, portrait)
+var imageSizes = map[string]bool{"1024x1024": true, "1792x1024": true, "1024x1792": true}
+
+// imageOptions reads options.size and options.n for dall-e. size has to be a real dall-e size (so typos don't go
+// upstream) and n gets clamped to 1-4
+func imageOptions(options ollamaOptions) (string, int, error) {
+	size, n := "1024x1024", 1
+	if v, ok := options.raw["size"]; ok {
+		s, _ := v.(string)
+		if !imageSizes[s] {
+			return "", 0, fmt.Errorf("invalid image size %v (use 1024x1024, 1792x1024 or 1024x1792)", v)
+		}
+		size = s
+	}
+	if v, ok := optionNumber(options.raw["n"]); ok {
+		n = int(v)
+		if n < 1 {
+			n = 1
+		} else if n > 4 {
+			n = 4
+		}
+	}
+	return size, n, nil
+}
+
+// ttsVoices are the voices the tts endpoint knows about
+var ttsVoices = map[string]bool{"alloy": true, "ash": true, "coral": true, "echo": true, "fable": true, "nova": true, "onyx": true, "sage": true, "shimmer": true}
+
+// pickVoice gets the tts voice from options.voice or a "voice:nova " prefix on the text (the prefix gets stripped so it
+// isn't read out loud). unknown voices fall back to the default which is "" (the upstream picks)
+func pickVoice(options ollamaOptions, text string) (string, string) {
+	voice := options.str("voice")
+	if rest, ok := strings.CutPrefix(text, "voice:"); ok {
+		name, spoken, _ := strings.Cut(rest, " ")
+		if voice == "" {
+			voice = name
+		}
+		text = spoken
+	}
+	voice = strings.ToLower(strings.TrimSpace(voice))
+	if voice != "" && !ttsVoices[voice] {
+		slog.Debug("unknown tts voice using the default", "voice", voice)
+		voice = ""
+	}
+	if voice == "" {
+		slog.Debug("tts voice", "voice", "default")
+	} else {
+		slog.Debug("tts voice", "voice", voice)
+	}
+	return voice, text
+}
+
+// cutAtStop cuts s right before the earliest stop string in it (empty stop strings are ignored)
+func cutAtStop(s string, stops []string) string {
+	cut := len(s)
+	for _, stop := range stops {
+		if stop == "" {
+			continue
+		}
+		if i := strings.Index(s, stop); i >= 0 && i < cut {
+			cut = i
+		}
+	}
+	return s[:cut]
+}
+
+// fillInMiddlePrompt turns a generate prompt + suffix (code completion clients) into one instruction, the chat models
+// upstream have no fim mode so they get asked for just the missing middle part. raw prompts get it too, the suffix
+// would be lost otherwise
+func fillInMiddlePrompt(prefix, suffix string) string {
+	return "Complete the text between PREFIX and SUFFIX. Reply with only the text that goes in between, no explanations " +
+		"and no code fences.\n\nPREFIX:\n" + prefix + "\n\nSUFFIX:\n" + suffix
+}
+
+// thinkOff reports if the client asked for no reasoning with "think": false (a missing field or a level doesn't count)
+func thinkOff(think interface{}) bool {
+	switch t := think.(type) {
+	case bool:
+		return !t
+	case string:
+		return strings.EqualFold(t, "false")
+	}
+	return false
+}
+
+// stripThink drops <think>...</think> blocks (and the whitespace after them) from a reply. an unclosed block is left
+// alone since there's no telling where the reasoning stops
+func stripThink(s string) string {
+	for {
+		start := strings.Index(s, "<think>")
+		if start < 0 {
+			return s
+		}
+		end := strings.Index(s[start:], "</think>")
+		if end < 0 {
+			return s
+		}
+		end += start + len("</think>")
+		s = s[:start] + strings.TrimLeft(s[end:], " \t\r\n")
+	}
+}
+
+// ollamaOptions is the request's options object. the options the proxy itself acts on get typed fields, everything
+// else stays in raw (the -forward-options passthrough and the model specific ones like size, voice and inline)
+type ollamaOptions struct {
+	Temperature *float64
+	TopP        *float64
+	Seed        *int
+	NumPredict  *int
+	Stop        []string // options.stop, a list of strings (ollama) or a single string (openai)
+	raw         map[string]interface{}
+}
+
+// UnmarshalJSON accepts numbers as ints, floats or numeric strings so "temperature": 1 or "0.5" don't silently
+// turn into the default. options that aren't an object at all are ignored like before
+func (o *ollamaOptions) UnmarshalJSON(b []byte) error {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		slog.Debug("ignoring options that aren't an object", "err", err)
+		*o = ollamaOptions{}
+		return nil
+	}
+	*o = ollamaOptions{raw: raw}
+	if v, ok := optionNumber(raw["temperature"]); ok {
+		o.Temperature = &v
+	}
+	if v, ok := optionNumber(raw["top_p"]); ok {
+		o.TopP = &v
+	}
+	if v, ok := optionNumber(raw["seed"]); ok {
+		seed := int(v)
+		o.Seed = &seed
+	}
+	if v, ok := optionNumber(raw["num_predict"]); ok {
+		n := int(v)
+		o.NumPredict = &n
+	}
+	switch stop := raw["stop"].(type) {
+	case string:
+		o.Stop = []string{stop}
+	case []interface{}:
+		for _, v := range stop {
+			if s, ok := v.(string); ok {
+				o.Stop = append(o.Stop, s)
+			}
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes the options back out as they came in
+func (o ollamaOptions) MarshalJSON() ([]byte, error) {
+	if o.raw == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.raw)
+}
+
+// str reads a string option, "" when it's missing or not a string
+func (o ollamaOptions) str(key string) string {
+	s, _ := o.raw[key].(string)
+	return s
+}
+
+// numPredict is options.num_predict (0 = not set, ollama's -1/-2 "no limit" values count as not set too)
+func (o ollamaOptions) numPredict() int {
+	if o.NumPredict == nil || *o.NumPredict < 1 {
+		return 0
+	}
+	return *o.NumPredict
+}
+
+// optionNumber reads a json number that may also have been sent as a numeric string
+func optionNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// wantsStream works out if a reply should stream: the global override wins, otherwise it streams unless the client
+// explicitly sent "stream": false (same default as ollama)
+func wantsStream(req ollamaReq) bool {
+	if streamOverride != nil {
+		return *streamOverride
+	}
+	return req.Stream == nil || *req.Stream
+}
+
+// base64ChunkSize is how many bytes of a base64 image go in one streamed frame
+const base64ChunkSize = 4096
+
+// runeChunks splits s into pieces of at most size bytes without cutting a utf-8 character in half
+func runeChunks(s string, size int) []string {
+	var chunks []string
+	for len(s) > 0 {
+		part := truncateRunes(s, size)
+		if part == "" {
+			_, n := utf8.DecodeRuneInString(s)
+			part = s[:n] // size is smaller than this one character, send it whole
+		}
+		chunks = append(chunks, part)
+		s = s[len(part):]
+	}
+	return chunks
+}
+
+// truncateRunes cuts s down to at most max bytes without splitting a utf-8 character in half
+func truncateRunes(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// writeChatReply sends a finished chat reply to the client, streamed in word chunks or as a single frame
+func writeChatReply(ctx context.Context, w http.ResponseWriter, cfg *config, req ollamaReq, model string, isGenerateRequest bool, reply string, upstreamMs int64, timing reqTiming) {
+	createdAt := nowRFC()
+	reportedMs := upstreamMs // kept for the duration metrics even when it isn't exposed
+	if !cfg.ExposeUpstreamMs {
+		upstreamMs = 0 // omitempty keeps it out of the body
+	}
+	// the upstream latency always goes in a header though (headers don't break any ollama client)
+	if reportedMs > 0 {
+		w.Header().Set("X-Upstream-Ms", strconv.FormatInt(reportedMs, 10))
+	}
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Type, X-Upstream-Ms")
+	doneReason := "stop"
+	seed := req.Options.Seed // echoed so tools recording seeds get them back (the upstream may not honor it)
+	if thinkOff(req.Think) {
+		reply = stripThink(reply)
+	}
+	// options.stop gets applied to the whole reply before it's chunked so a stop string can't hide across chunks
+	reply = cutAtStop(reply, req.Options.Stop)
+	// safety valve so a runaway upstream reply can't hang slow clients
+	if cfg.MaxReplyChars > 0 && len(reply) > cfg.MaxReplyChars {
+		slog.Debug("reply too long truncating it", "bytes", len(reply), "limit", cfg.MaxReplyChars)
+		reply = truncateRunes(reply, cfg.MaxReplyChars)
+		doneReason = "length"
+	}
+	// options.num_predict caps the reply at roughly that many tokens (words here) like real ollama does
+	if n := req.Options.numPredict(); n > 0 {
+		if words := SplitW(reply); len(words) > n {
+			reply = strings.Join(words[:n], "")
+			doneReason = "length"
+		}
+	}
+	// global override to prevent service from changing it
+	stream := req.Stream != nil && *req.Stream
+	// openai clients get what they asked for, a forced stream would only add chunk delays to a non-stream reply
+	openAI := isOpenAIRequest(ctx)
+	if !openAI {
+		if streamOverride != nil {
+			stream = *streamOverride
+		} else {
+			// fixed issues in some services by setting stream to on unless said otherwise by the service in ask mode
+			stream = true
+		}
+	}
+	if stream {
+		// actually proper x-ndjson (and no i don't have an idea on why half of this is a requirement but without it shit just turned into base64😭)
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Expires", "0")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		if cfg.SanitizeStream && !openAI {
+			// Remove all U+000A (Line Feed) characters from reply
+			reply = strings.ReplaceAll(reply, "\n", "")
+			cleaned := make([]rune, 0, len(reply))
+			for _, r := range reply {
+				// changed a bit to support new x-ndjson working properly
+				if (r >= 0x20 && r <= 0x7E) || r == 0x09 || (r >= 0x80) {
+					cleaned = append(cleaned, r)
+				}
+			}
+			reply = string(cleaned)
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "unsupported stream...", http.StatusInternalServerError)
+			return
+		}
+		// Stream shit in chunks to be faster and require less jsons (chunks are whole words now so a utf-8 character never gets split)
+		for i, chunk := range batchTokens(reply, cfg.ChunkSize) {
+			// yes the delay is pretty much required for some web services which are slow in the brain (-chunk-delay=0 for
+			// fast clients, it goes before the chunk so -instant-first-chunk can get the first one out right away)
+			if cfg.ChunkDelay > 0 && (i > 0 || !cfg.InstantFirstChunk) {
+				select {
+				case <-time.After(cfg.ChunkDelay):
+				case <-ctx.Done():
+				}
+			}
+			// client hung up, stop writing into a dead connection
+			if ctx.Err() != nil {
+				slog.Debug("client went away mid stream", "model", model, "err", ctx.Err())
+				return
+			}
+			// every frame carries the time it went out like real ollama, so clients timing the stream see it advance
+			stamp := nowRFC()
+			var respBytes []byte
+			if isGenerateRequest {
+				generateResp := ollamaGenerateResp{
+					Model:     model,
+					CreatedAt: stamp,
+					Response:  chunk,
+					Done:      false,
+				}
+				respBytes, _ = json.Marshal(generateResp)
+			} else {
+				chatResp := ollamaResp{
+					Model:     model,
+					CreatedAt: stamp,
+					Message: msg{
+						Role:    "assistant",
+						Content: chunk,
+					},
+					Done: false,
+				}
+				respBytes, _ = json.Marshal(chatResp)
+			}
+
+			// Ensure proper JSON line separation with explicit newline
+			w.Write(respBytes)
+			w.Write([]byte("\n"))
+			flusher.Flush()
+		}
+		// final metadata that is present in ollama WHY idk but some services need it so... (real numbers now so tokens/sec graphs mean something)
+		m := timing.metrics(time.Now(), reportedMs, req.Messages, reply, cfg.CharsPerToken)
+		usage := m.usage(cfg)
+		createdAt = nowRFC()
+		var finalrespbytes []byte
+		//modified a bit to work with /api/generate
+		if isGenerateRequest {
+			finalResp := ollamaGenerateResp{
+				Model:              model,
+				CreatedAt:          createdAt,
+				Response:           "",
+				DoneReason:         doneReason,
+				Done:               true,
+				TotalDuration:      m.total,
+				LoadDuration:       m.load,
+				PromptEvalCount:    m.promptCount,
+				PromptEvalDuration: m.promptEval,
+				EvalCount:          m.evalCount,
+				EvalDuration:       m.eval,
+				UpstreamMs:         upstreamMs,
+				Seed:               seed,
+				Usage:              usage,
+			}
+			finalrespbytes, _ = json.Marshal(finalResp)
 		} else {
+			finalResp := ollamaResp{
+				Model:              model,
+				CreatedAt:          createdAt,
+				Message:            msg{Role: "assistant", Content: ""},
+				DoneReason:         doneReason,
+				Done:               true,
+				TotalDuration:      m.total,
+				LoadDuration:       m.load,
+				PromptEvalCount:    m.promptCount,
+				PromptEvalDuration: m.promptEval,
+				EvalCount:          m.evalCount,
+				EvalDuration:       m.eval,
+				UpstreamMs:         upstreamMs,
+				Seed:               seed,
+				Usage:              usage,
+			}
+			finalrespbytes, _ = json.Marshal(finalResp)
+		}
+		w.Write(finalrespbytes)
+		w.Write([]byte("\n"))
+		flusher.Flush()
+		return
+	}
+	// single json for nostream /api/generate
+	m := timing.metrics(time.Now(), reportedMs, req.Messages, reply, cfg.CharsPerToken)
+	usage := m.usage(cfg)
+	var respBytes []byte
+	if isGenerateRequest {
+		generateResp := ollamaGenerateResp{
+			Model:              model,
+			CreatedAt:          createdAt,
+			Response:           reply,
+			DoneReason:         doneReason,
+			Done:               true,
+			TotalDuration:      m.total,
+			LoadDuration:       m.load,
+			PromptEvalCount:    m.promptCount,
+			PromptEvalDuration: m.promptEval,
+			EvalCount:          m.evalCount,
+			EvalDuration:       m.eval,
+			UpstreamMs:         upstreamMs,
+			Seed:               seed,
+			Usage:              usage,
+		}
+		respBytes, _ = json.Marshal(generateResp)
+	} else {
+		chatResp := ollamaResp{
+			Model:     model,
+			CreatedAt: createdAt,
+			Message: msg{
+				Role:    "assistant",
+				Content: reply,
+			},
+			DoneReason:         doneReason,
+			Done:               true,
+			TotalDuration:      m.total,
+			LoadDuration:       m.load,
+			PromptEvalCount:    m.promptCount,
+			PromptEvalDuration: m.promptEval,
+			EvalCount:          m.evalCount,
+			EvalDuration:       m.eval,
+			UpstreamMs:         upstreamMs,
+			Seed:               seed,
+			Usage:              usage,
+		}
+		respBytes, _ = json.Marshal(chatResp)
+	}
+	w.Write(respBytes)
+	w.Write([]byte("\n"))
+}
+
+// keepaliveFrame is an empty not done frame in the chat or generate shape, stamped with the time it's built
+func keepaliveFrame(model string, isGenerate bool) []byte {
+	var b []byte
+	if isGenerate {
+		b, _ = json.Marshal(ollamaGenerateResp{Model: model, CreatedAt: nowRFC()})
+	} else {
+		b, _ = json.Marshal(ollamaResp{Model: model, CreatedAt: nowRFC(), Message: msg{Role: "assistant"}})
+	}
+	return b
+}
+
+// keepAliveWhile runs work and writes a fresh frame() as an ndjson line every interval until it's done (fresh so every
+// frame carries its own created_at). true means at least one frame went out (so the 200 + ndjson headers are already sent)
+func keepAliveWhile(w http.ResponseWriter, every time.Duration, frame func() []byte, work func()) bool {
+	done := make(chan struct{})
+	go func() {
+		work()
+		close(done)
+	}()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	started := false
+	for {
+		select {
+		case <-done:
+			return started
+		case <-ticker.C:
+			if !started {
+				w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+				w.Header().Set("Cache-Control", "no-cache")
+				w.Header().Set("X-Accel-Buffering", "no")
+				w.WriteHeader(http.StatusOK)
+				started = true
+			}
+			w.Write(frame())
+			w.Write([]byte("\n"))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+}
+
+// keepaliveWriter is what hChat writes through once keep-alive frames went out. the status and headers are already
+// sent so later changes get dropped (a late {"error": ...} still goes out as a line like ollama does mid stream)
+type keepaliveWriter struct {
+	http.ResponseWriter
+	header http.Header
+}
+
+func (k *keepaliveWriter) Header() http.Header { return k.header }
+
+func (k *keepaliveWriter) WriteHeader(int) {}
+
+func (k *keepaliveWriter) Flush() {
+	if f, ok := k.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// sseWriter turns hChat's ndjson into server sent events: every line becomes a "data: {json}" event and finish adds
+// the closing "data: [DONE]". error statuses go out untouched as plain json
+type sseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	events      bool // 2xx so the body is being sent as events
+	pending     []byte
+}
+
+func (s *sseWriter) WriteHeader(status int) {
+	if s.wroteHeader {
+		return
+	}
+	s.wroteHeader = true
+	if status < 300 {
+		s.events = true
+		s.Header().Set("Content-Type", "text/event-stream")
+		s.Header().Set("Cache-Control", "no-cache")
+		s.Header().Del("Content-Length")
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *sseWriter) Write(p []byte) (int, error) {
+	if !s.wroteHeader {
+		s.WriteHeader(http.StatusOK)
+	}
+	if !s.events {
+		return s.ResponseWriter.Write(p)
+	}
+	s.pending = append(s.pending, p...)
+	for {
+		i := bytes.IndexByte(s.pending, '\n')
+		if i < 0 {
 			break
 		}
+		if err := s.event(s.pending[:i]); err != nil {
+			return 0, err
+		}
+		s.pending = s.pending[i+1:]
 	}
+	return len(p), nil
+}
 
-	result := append(systemMessages, circumsized...)
-	if debug {
-		fmt.Printf("[DEBUG] Prompt circumsized from %d to %d characters\n", totalLength, currentLength)
+// event writes one line as a data: event (blank lines are skipped)
+func (s *sseWriter) event(line []byte) error {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
 	}
+	_, err := s.ResponseWriter.Write(append(append([]byte("data: "), line...), '\n', '\n'))
+	return err
+}
 
-	return result
+func (s *sseWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends whatever is left of an unterminated line and the [DONE] event
+func (s *sseWriter) finish() {
+	if !s.events {
+		return
+	}
+	s.event(s.pending)
+	s.pending = nil
+	s.ResponseWriter.Write([]byte("data: [DONE]\n\n"))
+	s.Flush()
+}
+
+// writeOllamaError answers with something the model "says" (blocked, too long, ratelimited...) as a 200 done frame in
+// the chat or generate shape so chat UIs show it like a normal reply instead of an error popup
+func writeOllamaError(w http.ResponseWriter, model string, isGenerate bool, message string) {
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	var respBytes []byte
+	if isGenerate {
+		respBytes, _ = json.Marshal(ollamaGenerateResp{
+			Model:      model,
+			CreatedAt:  nowRFC(),
+			Response:   message,
+			DoneReason: "stop",
+			Done:       true,
+		})
+	} else {
+		respBytes, _ = json.Marshal(ollamaResp{
+			Model:     model,
+			CreatedAt: nowRFC(),
+			Message: msg{
+				Role:    "assistant",
+				Content: message,
+			},
+			DoneReason: "stop",
+			Done:       true,
+		})
+	}
+	w.Write(respBytes)
+	w.Write([]byte("\n"))
+}
+
+// writeJSONError writes an ollama style {"error": "..."} body with a real http status (for stuff the client should handle not display)
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	b, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
 }
 
 func nowRFC() string {
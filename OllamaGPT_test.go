@@ -0,0 +1,949 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/segmentio/encoding/json"
+)
+
+// testConfig loads a config the way main does (defaults, then args) minus the console questions and makes it the live
+// one for the test
+func testConfig(t *testing.T, args ...string) *config {
+	t.Helper()
+	cfg, err := loadConfig(append([]string{"-stream=ask", "-dementia=off", "-chunk-delay=0"}, args...), flag.ContinueOnError)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	old := liveCfg.Load()
+	liveCfg.Store(cfg)
+	t.Cleanup(func() { liveCfg.Store(old) })
+	if err := reloadTags(cfg); err != nil {
+		t.Fatalf("reloadTags: %v", err)
+	}
+	return cfg
+}
+
+// seenRequest is one call a fakeUpstream got
+type seenRequest struct {
+	path string
+	body []byte
+}
+
+// fakeUpstream is an httptest pfuner.xyz stand in that remembers every request it got
+type fakeUpstream struct {
+	*httptest.Server
+	mu   sync.Mutex
+	seen []seenRequest
+}
+
+func newFakeUpstream(t *testing.T, reply http.HandlerFunc) *fakeUpstream {
+	t.Helper()
+	f := &fakeUpstream{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.seen = append(f.seen, seenRequest{path: r.URL.Path, body: b})
+		f.mu.Unlock()
+		reply(w, r)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeUpstream) requests() []seenRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]seenRequest(nil), f.seen...)
+}
+
+// chatUpstream answers v1 with {"reply": reply} and v2 with {"content": reply} like the real thing
+func chatUpstream(reply string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		key := "reply"
+		if r.URL.Path == "/v2/chat/completions" {
+			key = "content"
+		}
+		b, _ := json.Marshal(map[string]interface{}{key: reply, "ms": 1})
+		w.Write(b)
+	}
+}
+
+// serve runs one request through h and returns what it wrote
+func serve(h http.HandlerFunc, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// jsonString is s as a json string literal
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// replyFrames decodes an ndjson chat reply (a single json object works too)
+func replyFrames(t *testing.T, body string) []ollamaResp {
+	t.Helper()
+	var frames []ollamaResp
+	for _, line := range strings.Split(body, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var f ollamaResp
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("bad frame %q: %v", line, err)
+		}
+		frames = append(frames, f)
+	}
+	return frames
+}
+
+// generateText joins the response fields of an ndjson /api/generate reply
+func generateText(t *testing.T, body string) string {
+	t.Helper()
+	var sb strings.Builder
+	for _, line := range strings.Split(body, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var f ollamaGenerateResp
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("bad frame %q: %v", line, err)
+		}
+		sb.WriteString(f.Response)
+	}
+	return sb.String()
+}
+
+// checkSentMessages compares the messages field of an upstream request body with want (json, key order doesn't matter)
+func checkSentMessages(t *testing.T, body []byte, want string) {
+	t.Helper()
+	var sent struct {
+		Messages json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &sent); err != nil {
+		t.Fatalf("upstream body %s: %v", body, err)
+	}
+	var got, expected interface{}
+	json.Unmarshal(sent.Messages, &got)
+	json.Unmarshal([]byte(want), &expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("messages = %s, want %s", sent.Messages, want)
+	}
+}
+
+func TestRawGenerateSkipsSystemPrompts(t *testing.T) {
+	tests := []struct {
+		name  string
+		model string
+		path  string
+		want  string // the messages the upstream should get, as json
+	}{
+		{"v2", "gpt-4o", "/v2/chat/completions", `[{"content":"RAWP","role":"user"}]`},
+		{"v1", "gpt-3.5", "/v1/chat/completions", `["RAWP"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream("ok"))
+			testConfig(t, "-upstream", up.URL, "-system-prompt", "HOUSE")
+			body := `{"model":"` + tt.model + `","prompt":"RAWP","system":"SYS","raw":true,"stream":false}`
+			if w := serve(hChat, http.MethodPost, "/api/generate", body); w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			seen := up.requests()
+			if len(seen) != 1 || seen[0].path != tt.path {
+				t.Fatalf("upstream got %+v", seen)
+			}
+			checkSentMessages(t, seen[0].body, tt.want)
+		})
+	}
+}
+
+func TestOpenAIChatKeepsRolesAndOrder(t *testing.T) {
+	tests := []struct {
+		model string
+		want  string
+	}{
+		{"gpt-4o", `[{"role":"system","content":"be brief"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"bye"}]`},
+		{"gpt-3.5", `["System: be brief","User: hi","Assistant: hello","User: bye"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream("ok"))
+			testConfig(t, "-upstream", up.URL)
+			body := `{"model":"` + tt.model + `","messages":[{"role":"system","content":"be brief"},{"role":"user","content":"hi"},{"role":"assistant","content":"hello"},{"role":"user","content":"bye"}]}`
+			if w := serve(hOpenAIChat, http.MethodPost, "/v1/chat/completions", body); w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			seen := up.requests()
+			if len(seen) != 1 {
+				t.Fatalf("upstream got %d requests, want 1", len(seen))
+			}
+			checkSentMessages(t, seen[0].body, tt.want)
+		})
+	}
+}
+
+func TestCircumsizeMKeepsSystemMessagesFirst(t *testing.T) {
+	sys := func(s string) msg { return msg{Role: "system", Content: s} }
+	user := func(s string) msg { return msg{Role: "user", Content: s} }
+	bot := func(s string) msg { return msg{Role: "assistant", Content: s} }
+	tests := []struct {
+		name     string
+		messages []msg
+		limit    int
+		want     []msg
+	}{
+		{
+			name:     "system before the turns",
+			messages: []msg{sys("S1"), user("1111"), bot("2222"), user("3333")},
+			limit:    8,
+			want:     []msg{sys("S1"), bot("2222"), user("3333")},
+		},
+		{
+			name:     "system between the turns",
+			messages: []msg{user("aaaa"), bot("bbbb"), sys("S1"), user("cccc"), sys("S2"), bot("dddd"), user("ee")},
+			limit:    6,
+			want:     []msg{sys("S1"), sys("S2"), bot("dddd"), user("ee")},
+		},
+		{
+			name:     "system before, between and after the turns",
+			messages: []msg{sys("S1"), user("aaaa"), bot("bbbb"), sys("S2"), user("cccc"), bot("dddd"), user("ee"), sys("S3")},
+			limit:    6,
+			want:     []msg{sys("S1"), sys("S2"), sys("S3"), bot("dddd"), user("ee")},
+		},
+		{
+			name:     "system after the turns",
+			messages: []msg{user("1111"), bot("2222"), user("33"), sys("S1")},
+			limit:    4,
+			want:     []msg{sys("S1"), user("33")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := circumsizeM(tt.messages, tt.limit, 0)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("circumsizeM = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchTokensRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{"ascii", "hello there, how are you doing today?"},
+		{"cjk", "你好 世界 这是 一个 测试"},
+		{"emoji", "ok 😀😃 great 👍🏽 family 👨‍👩‍👧 done"},
+		{"newlines and tabs", "line one\nline two\n\n\tindented  double  spaces \n"},
+		{"multibyte on chunk boundaries", "a 日 bb 本語 c😀 dé €€ ü"},
+		{"mixed", "Hi 你好 😀\n```go\nfmt.Println(\"ü\")\n```\nend 🎉"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(SplitW(tt.reply), ""); got != tt.reply {
+				t.Fatalf("SplitW joined = %q, want %q", got, tt.reply)
+			}
+			for size := 1; size <= 8; size++ {
+				chunks := batchTokens(tt.reply, size)
+				for _, c := range chunks {
+					if !utf8.ValidString(c) {
+						t.Fatalf("size %d: chunk %q has a partial rune", size, c)
+					}
+				}
+				if got := strings.Join(chunks, ""); got != tt.reply {
+					t.Fatalf("size %d: chunks joined = %q, want %q", size, got, tt.reply)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamedReplyReassembles(t *testing.T) {
+	testConfig(t, "-chunk-size=2", "-sanitize-stream=false")
+	reply := "Hi 你好 😀\nsecond line\tend 🎉"
+	body := `{"model":"echo","messages":[{"role":"user","content":` + jsonString(reply) + `}]}`
+	w := serve(hChat, http.MethodPost, "/api/chat", body)
+	frames := replyFrames(t, w.Body.String())
+	if len(frames) < 3 {
+		t.Fatalf("got %d frames, want the reply spread over several", len(frames))
+	}
+	var got strings.Builder
+	for _, f := range frames {
+		got.WriteString(f.Message.Content)
+	}
+	if got.String() != reply {
+		t.Errorf("reassembled = %q, want %q", got.String(), reply)
+	}
+}
+
+func TestErrorReplies(t *testing.T) {
+	for _, stream := range []bool{true, false} {
+		streamField := `,"stream":false`
+		if stream {
+			streamField = `,"stream":true`
+		}
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			// a broken request is a real http error with ollama's {"error": ...} body
+			testConfig(t)
+			w := serve(hChat, http.MethodPost, "/api/chat", `{"model":"gpt-4o","messages":[`+streamField)
+			var e struct {
+				Error string `json:"error"`
+			}
+			if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Error != "invalid json" {
+				t.Errorf("bad json: status %d body %q, want 400 {\"error\":\"invalid json\"}", w.Code, w.Body)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("bad json: content type %q", ct)
+			}
+
+			// an inference level failure (ratelimited) is a 200 ndjson done frame the chat UI just shows
+			up := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTooManyRequests)
+			})
+			testConfig(t, "-upstream", up.URL, "-retries=0")
+			w = serve(hChat, http.MethodPost, "/api/chat", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]`+streamField+`}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("ratelimited: status %d, want 200", w.Code)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/x-ndjson") {
+				t.Errorf("ratelimited: content type %q", ct)
+			}
+			frames := replyFrames(t, w.Body.String())
+			if len(frames) != 1 || !frames[0].Done || !strings.Contains(frames[0].Message.Content, "Too many requests") {
+				t.Errorf("ratelimited: frames %+v, want one done frame with the ratelimit message", frames)
+			}
+		})
+	}
+}
+
+func TestTaskScanScopeLatest(t *testing.T) {
+	messages := []msg{
+		{Role: "system", Content: "be nice"},
+		{Role: "user", Content: "### Task: suggest a title"},
+		{Role: "assistant", Content: "Chat about cats"},
+		{Role: "user", Content: "tell me about cats"},
+		{Role: "assistant", Content: "cats are great"},
+	}
+	cfg := testConfig(t)
+	if got, want := taskScanScope(cfg, messages), messages[3:4]; !reflect.DeepEqual(got, want) {
+		t.Errorf("latest scope = %+v, want only the newest user message %+v", got, want)
+	}
+
+	tests := []struct {
+		scope   string
+		blocked bool
+	}{
+		{"latest", false}, // the old task message doesn't matter anymore
+		{"all", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream("ok"))
+			testConfig(t, "-upstream", up.URL, "-task-scope="+tt.scope)
+			b, _ := json.Marshal(map[string]interface{}{"model": "gpt-4o", "messages": messages, "stream": false})
+			w := serve(hChat, http.MethodPost, "/api/chat", string(b))
+			blocked := strings.Contains(w.Body.String(), "unnecessary api spam")
+			if blocked != tt.blocked || (len(up.requests()) == 0) != tt.blocked {
+				t.Errorf("blocked = %v with %d upstream calls, want blocked %v (body %s)", blocked, len(up.requests()), tt.blocked, w.Body)
+			}
+		})
+	}
+}
+
+func TestCircumsizeMGiantTrailingUserMessage(t *testing.T) {
+	giant := strings.Repeat("question 你好 😀 ", 500)
+	tests := []struct {
+		name          string
+		messages      []msg
+		limit         int
+		charsPerToken float64
+	}{
+		{"alone", []msg{{Role: "user", Content: giant}}, 100, 0},
+		{"alone, token estimate", []msg{{Role: "user", Content: giant}}, 100, 4},
+		{"with history and system", []msg{{Role: "system", Content: "sys"}, {Role: "user", Content: "old"}, {Role: "assistant", Content: "reply"}, {Role: "user", Content: giant}}, 100, 0},
+		{"budget of 1", []msg{{Role: "user", Content: giant}}, 1, 0},
+		{"no budget at all", []msg{{Role: "user", Content: giant}}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := circumsizeM(tt.messages, tt.limit, tt.charsPerToken)
+			if len(got) == 0 {
+				t.Fatal("everything got dropped")
+			}
+			last := got[len(got)-1]
+			if last.Role != "user" || !strings.HasSuffix(giant, last.Content) {
+				t.Fatalf("last message = %q (%s), want the tail of the giant user message", last.Content, last.Role)
+			}
+			if !utf8.ValidString(last.Content) {
+				t.Errorf("truncated message has a partial rune")
+			}
+			if n, budget := estimateTokens(last.Content, tt.charsPerToken), tokenBudget(tt.limit, tt.charsPerToken); n > budget {
+				t.Errorf("kept %d tokens, budget is %d", n, budget)
+			}
+			if tt.messages[0].Role == "system" && !reflect.DeepEqual(got[0], tt.messages[0]) {
+				t.Errorf("system message lost: %+v", got)
+			}
+		})
+	}
+}
+
+func TestOpenAIChatPassesReplyThrough(t *testing.T) {
+	// -stream=on must not turn a non-stream openai request into a stream, and sanitizing must not eat the newline
+	on := true
+	streamOverride = &on
+	t.Cleanup(func() { streamOverride = nil })
+	for _, stream := range []bool{true, false} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream("a\nb"))
+			testConfig(t, "-upstream", up.URL, "-chunk-size=1")
+			body := fmt.Sprintf(`{"model":"gpt-4o","stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream)
+			w := serve(hOpenAIChat, http.MethodPost, "/v1/chat/completions", body)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", w.Code, w.Body)
+			}
+			var got strings.Builder
+			if stream {
+				for _, line := range strings.Split(w.Body.String(), "\n") {
+					data, ok := strings.CutPrefix(line, "data: ")
+					if !ok || data == "[DONE]" {
+						continue
+					}
+					var chunk struct {
+						Choices []struct {
+							Delta struct {
+								Content string `json:"content"`
+							} `json:"delta"`
+						} `json:"choices"`
+					}
+					if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+						t.Fatalf("bad chunk %q: %v", data, err)
+					}
+					for _, c := range chunk.Choices {
+						got.WriteString(c.Delta.Content)
+					}
+				}
+			} else {
+				var completion struct {
+					Object  string `json:"object"`
+					Choices []struct {
+						Message struct {
+							Content string `json:"content"`
+						} `json:"message"`
+					} `json:"choices"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &completion); err != nil || completion.Object != "chat.completion" || len(completion.Choices) != 1 {
+					t.Fatalf("not a chat.completion: %s", w.Body)
+				}
+				got.WriteString(completion.Choices[0].Message.Content)
+			}
+			if got.String() != "a\nb" {
+				t.Errorf("content = %q, want %q", got.String(), "a\nb")
+			}
+		})
+	}
+}
+
+func TestKeepAliveAndOptionsDecoding(t *testing.T) {
+	testConfig(t)
+	tests := []struct {
+		name   string
+		extra  string // fields added to the request
+		status int
+	}{
+		{"keep_alive string", `"keep_alive":"5m"`, http.StatusOK},
+		{"keep_alive number", `"keep_alive":300`, http.StatusOK},
+		{"keep_alive negative", `"keep_alive":-1`, http.StatusOK},
+		{"keep_alive object", `"keep_alive":{"minutes":5}`, http.StatusOK},
+		{"keep_alive null", `"keep_alive":null`, http.StatusOK},
+		{"options not an object", `"options":"fast"`, http.StatusOK},
+		{"options with string numbers", `"options":{"temperature":"0.5","num_predict":"x"}`, http.StatusOK},
+		{"broken json", `"keep_alive":5m`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/api/chat", "/api/generate"} {
+			t.Run(tt.name+" "+path, func(t *testing.T) {
+				body := `{"model":"echo","messages":[{"role":"user","content":"hi"}],"stream":false,` + tt.extra + `}`
+				if path == "/api/generate" {
+					body = `{"model":"echo","prompt":"hi","stream":false,` + tt.extra + `}`
+				}
+				w := serve(hChat, http.MethodPost, path, body)
+				if w.Code != tt.status {
+					t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+				}
+				if tt.status == http.StatusOK && !strings.Contains(w.Body.String(), `"hi"`) {
+					t.Errorf("echo reply missing: %s", w.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestOllamaOptionsUnmarshal(t *testing.T) {
+	var req ollamaReq
+	if err := json.Unmarshal([]byte(`{"options":{"temperature":1,"top_p":"0.5","seed":42.0,"num_predict":"x","stop":"END","voice":"nova"}}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	o := req.Options
+	if o.Temperature == nil || *o.Temperature != 1 || o.TopP == nil || *o.TopP != 0.5 || o.Seed == nil || *o.Seed != 42 {
+		t.Errorf("numbers not read: %+v", o)
+	}
+	if o.NumPredict != nil || o.numPredict() != 0 {
+		t.Errorf("num_predict %q should count as not set", "x")
+	}
+	if !reflect.DeepEqual(o.Stop, []string{"END"}) || o.str("voice") != "nova" {
+		t.Errorf("stop = %v, voice = %q", o.Stop, o.str("voice"))
+	}
+	for _, invalid := range []string{`"fast"`, `[1,2]`, `12`, `null`} {
+		var req ollamaReq
+		if err := json.Unmarshal([]byte(`{"options":`+invalid+`}`), &req); err != nil {
+			t.Errorf("options %s: %v", invalid, err)
+		}
+		if req.Options.Temperature != nil || req.Options.raw != nil {
+			t.Errorf("options %s should be ignored, got %+v", invalid, req.Options)
+		}
+	}
+}
+
+func TestModelTagsRouteToTheBaseModel(t *testing.T) {
+	tests := []struct {
+		model string
+		route string
+	}{
+		{"gpt-4o", "gpt-4o"},
+		{"gpt-4o:latest", "gpt-4o"},
+		{"gpt-4o:anything", "gpt-4o"},
+		{"assistant:v2", "gpt-4o"}, // -alias target
+		{"mystery:latest", "gpt-3.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream("ok"))
+			testConfig(t, "-upstream", up.URL, "-alias", "assistant=gpt-4o")
+			if got := modelRoute(resolveAlias(baseModelName(tt.model))); got != tt.route {
+				t.Fatalf("route = %q, want %q", got, tt.route)
+			}
+			w := serve(hChat, http.MethodPost, "/api/chat", `{"model":"`+tt.model+`","messages":[{"role":"user","content":"hi"}],"stream":false}`)
+			frames := replyFrames(t, w.Body.String())
+			if len(frames) == 0 || frames[0].Model != tt.model {
+				t.Errorf("reply model = %+v, want the name as asked %q", frames, tt.model)
+			}
+			seen := up.requests()
+			wantPath := "/v1/chat/completions"
+			if tt.route == "gpt-4o" {
+				wantPath = "/v2/chat/completions"
+			}
+			if len(seen) != 1 || seen[0].path != wantPath {
+				t.Errorf("upstream got %+v, want one call to %s", seen, wantPath)
+			}
+		})
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	metrics.request("metrics-test", false)
+	metrics.request("metrics-test", true)
+	metrics.upstream("metrics-test", 400*time.Millisecond, "")
+	metrics.upstream("metrics-test", 3*time.Second, "metrics-test-class")
+	w := serve(hMetrics, http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		t.Fatalf("status %d, content type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	out := w.Body.String()
+	for _, want := range []string{
+		"# TYPE ollamagpt_requests_total counter",
+		`ollamagpt_requests_total{model="metrics-test"} 2`,
+		"# TYPE ollamagpt_upstream_duration_seconds histogram",
+		`ollamagpt_upstream_duration_seconds_bucket{model="metrics-test",le="0.25"} 0`,
+		`ollamagpt_upstream_duration_seconds_bucket{model="metrics-test",le="0.5"} 1`,
+		`ollamagpt_upstream_duration_seconds_bucket{model="metrics-test",le="5"} 2`,
+		`ollamagpt_upstream_duration_seconds_bucket{model="metrics-test",le="+Inf"} 2`,
+		`ollamagpt_upstream_duration_seconds_sum{model="metrics-test"} 3.4`,
+		`ollamagpt_upstream_duration_seconds_count{model="metrics-test"} 2`,
+		"# TYPE ollamagpt_upstream_errors_total counter",
+		`ollamagpt_upstream_errors_total{class="metrics-test-class"} 1`,
+		"# TYPE ollamagpt_blocked_total counter",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestEmptyMessagesRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"empty", `{"model":"gpt-4o","messages":[]}`},
+		{"null", `{"model":"gpt-4o","messages":null}`},
+		{"missing", `{"model":"gpt-4o"}`},
+		{"missing with a system field", `{"model":"gpt-4o","system":"be nice"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream("ok"))
+			testConfig(t, "-upstream", up.URL)
+			w := serve(hChat, http.MethodPost, "/api/chat", tt.body)
+			var e struct {
+				Error string `json:"error"`
+			}
+			if w.Code != http.StatusBadRequest || json.Unmarshal(w.Body.Bytes(), &e) != nil || e.Error != "no messages provided" {
+				t.Errorf("status %d body %q, want 400 {\"error\":\"no messages provided\"}", w.Code, w.Body)
+			}
+			if n := len(up.requests()); n != 0 {
+				t.Errorf("upstream got %d requests, want none", n)
+			}
+		})
+	}
+}
+
+func TestRawGenerateWithFormatJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		reply    string
+		calls    int // a reply that isn't json gets asked for once more
+		response string
+	}{
+		{"valid json", `{"a":1}`, 1, `{"a":1}`},
+		{"not json", `sure: a=1`, 2, `{"response":"sure: a=1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream(tt.reply))
+			testConfig(t, "-upstream", up.URL)
+			w := serve(hChat, http.MethodPost, "/api/generate", `{"model":"gpt-4o","prompt":"RAWP","raw":true,"format":"json","stream":false}`)
+			seen := up.requests()
+			if len(seen) != tt.calls {
+				t.Fatalf("upstream got %d requests, want %d", len(seen), tt.calls)
+			}
+			for _, req := range seen {
+				checkSentMessages(t, req.body, `[{"role":"user","content":"RAWP"}]`)
+			}
+			if got := generateText(t, w.Body.String()); got != tt.response {
+				t.Errorf("response = %q, want %q", got, tt.response)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"7", 7 * time.Second, true},
+		{"0", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true}, // already passed, retry right away
+		{"-3", 0, false},
+		{"soon", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if got, ok := retryAfter(resp, now); got != tt.want || ok != tt.ok {
+			t.Errorf("retryAfter(%q) = %v, %v, want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRetryAfterFromUpstream(t *testing.T) {
+	tests := []struct {
+		name   string
+		header func() string
+	}{
+		{"seconds", func() string { return "1" }},
+		{"http date", func() string { return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" retried", func(t *testing.T) {
+			var mu sync.Mutex
+			var calls []time.Time
+			up := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				calls = append(calls, time.Now())
+				first := len(calls) == 1
+				mu.Unlock()
+				if first {
+					w.Header().Set("Retry-After", tt.header())
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				chatUpstream("ok")(w, r)
+			})
+			testConfig(t, "-upstream", up.URL, "-retries=1", "-retry-on=429", "-retry-delay=1ms")
+			w := serve(hChat, http.MethodPost, "/api/chat", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":false}`)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(calls) != 2 {
+				t.Fatalf("upstream got %d calls, want 2", len(calls))
+			}
+			// the date form only has whole seconds so it can come out up to a second short
+			if gap := calls[1].Sub(calls[0]); gap < 900*time.Millisecond {
+				t.Errorf("retried after %v, want the Retry-After wait instead of -retry-delay", gap)
+			}
+			if got := replyFrames(t, w.Body.String()); len(got) == 0 || got[0].Message.Content != "ok" {
+				t.Errorf("reply = %s", w.Body)
+			}
+		})
+	}
+
+	messages := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"seconds", "7", `wait 7s`},
+		{"http date", time.Now().Add(2 * time.Minute).UTC().Format(http.TimeFormat), `wait (1m5[89]s|2m0s)`}, // whole seconds only
+	}
+	for _, tt := range messages {
+		t.Run(tt.name+" in the message", func(t *testing.T) {
+			up := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", tt.header)
+				w.WriteHeader(http.StatusTooManyRequests)
+			})
+			testConfig(t, "-upstream", up.URL, "-retries=0")
+			w := serve(hChat, http.MethodPost, "/api/chat", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}],"stream":false}`)
+			if !regexp.MustCompile(`Too many requests please ` + tt.want + `\.\.\.`).MatchString(w.Body.String()) {
+				t.Errorf("reply %s doesn't match %q", w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestDallEReturnsEveryImage(t *testing.T) {
+	urls := []string{"https://img.example/1.png", "https://img.example/2.png", "https://img.example/3.png"}
+	up := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var data []map[string]string
+		for _, u := range urls {
+			data = append(data, map[string]string{"url": u, "revised_prompt": "a cat"})
+		}
+		b, _ := json.Marshal(map[string]interface{}{"created": 1, "data": data})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+	testConfig(t, "-upstream", up.URL)
+	w := serve(hChat, http.MethodPost, "/api/chat", `{"model":"dall-e-3","messages":[{"role":"user","content":"a cat"}],"options":{"n":3},"stream":false}`)
+	seen := up.requests()
+	if len(seen) != 1 || seen[0].path != "/v3/images/generations" {
+		t.Fatalf("upstream got %+v", seen)
+	}
+	var sent struct {
+		N int `json:"n"`
+	}
+	if json.Unmarshal(seen[0].body, &sent); sent.N != 3 {
+		t.Errorf("n = %d sent upstream, want 3", sent.N)
+	}
+	frames := replyFrames(t, w.Body.String())
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames, want 1: %s", len(frames), w.Body)
+	}
+	if got, want := frames[0].Message.Content, strings.Join(urls, "\n"); got != want {
+		t.Errorf("content = %q, want every url in order %q", got, want)
+	}
+}
+
+func TestEffectiveLogLevel(t *testing.T) {
+	tests := []struct {
+		minLevel string
+		debug    bool
+		want     slog.Level
+	}{
+		{"", true, slog.LevelDebug},
+		{"", false, slog.LevelInfo},
+		{"warn", true, slog.LevelWarn}, // an explicit -log-level beats debug mode
+		{"error", false, slog.LevelError},
+		{"debug", false, slog.LevelDebug},
+	}
+	for _, tt := range tests {
+		if got := effectiveLogLevel(tt.minLevel, tt.debug); got != tt.want {
+			t.Errorf("effectiveLogLevel(%q, %v) = %v, want %v", tt.minLevel, tt.debug, got, tt.want)
+		}
+	}
+}
+
+func TestReloadChangesLogLevel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldArgs, oldLogger := os.Args, slog.Default()
+	t.Cleanup(func() {
+		os.Args = oldArgs
+		slog.SetDefault(oldLogger)
+	})
+	os.Args = []string{"ollamagpt", "-config", path, "-stream=ask", "-dementia=off"}
+
+	write(`{"log-level": "warn"}`)
+	cfg := testConfig(t, os.Args[1:]...)
+	setupLogger("text", cfg.LogLevel, cfg.debugMode())
+	if got := logLevel.Level(); got != slog.LevelWarn {
+		t.Fatalf("start level = %v, want WARN", got)
+	}
+	steps := []struct {
+		file string
+		want slog.Level
+	}{
+		{`{"log-level": "error"}`, slog.LevelError},
+		{`{"debug": true}`, slog.LevelDebug},
+		{`{"debug": false}`, slog.LevelInfo},
+	}
+	for _, step := range steps {
+		write(step.file)
+		reloadConfig()
+		if got := logLevel.Level(); got != step.want {
+			t.Errorf("after reloading %s level = %v, want %v", step.file, got, step.want)
+		}
+		if !slog.Default().Enabled(context.Background(), step.want) || slog.Default().Enabled(context.Background(), step.want-1) {
+			t.Errorf("after reloading %s the default logger doesn't filter at %v", step.file, step.want)
+		}
+	}
+}
+
+func TestCircumsizeMPacksPastOversizedMessage(t *testing.T) {
+	big := strings.Repeat("x", 50)
+	tests := []struct {
+		name     string
+		messages []msg
+		want     []msg
+	}{
+		{
+			name:     "big assistant between two small ones",
+			messages: []msg{{Role: "user", Content: "s1"}, {Role: "assistant", Content: big}, {Role: "user", Content: "s2"}, {Role: "assistant", Content: "ok"}, {Role: "user", Content: "q"}},
+			want:     []msg{{Role: "user", Content: "s1"}, {Role: "user", Content: "s2"}, {Role: "assistant", Content: "ok"}, {Role: "user", Content: "q"}},
+		},
+		{
+			name:     "big user between two small ones",
+			messages: []msg{{Role: "system", Content: "sys"}, {Role: "assistant", Content: "s1"}, {Role: "user", Content: big}, {Role: "assistant", Content: "s2"}, {Role: "user", Content: "q"}},
+			want:     []msg{{Role: "system", Content: "sys"}, {Role: "assistant", Content: "s1"}, {Role: "assistant", Content: "s2"}, {Role: "user", Content: "q"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := circumsizeM(tt.messages, 10, 0); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("circumsizeM = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThinkField(t *testing.T) {
+	reply := "<think>the user wants a greeting</think> Hello there"
+	tests := []struct {
+		think string
+		want  string
+	}{
+		{`true`, reply},
+		{`"high"`, reply},
+		{`false`, "Hello there"},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{"/api/chat", "/api/generate"} {
+			t.Run("think="+tt.think+" "+path, func(t *testing.T) {
+				testConfig(t)
+				body := `{"model":"echo","think":` + tt.think + `,"messages":[{"role":"user","content":` + jsonString(reply) + `}]}`
+				if path == "/api/generate" {
+					body = `{"model":"echo","think":` + tt.think + `,"prompt":` + jsonString(reply) + `}`
+				}
+				w := serve(hChat, http.MethodPost, path, body)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+				var got string
+				if path == "/api/generate" {
+					got = generateText(t, w.Body.String())
+				} else {
+					var sb strings.Builder
+					for _, f := range replyFrames(t, w.Body.String()) {
+						sb.WriteString(f.Message.Content)
+					}
+					got = sb.String()
+				}
+				if got != tt.want {
+					t.Errorf("reply = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestKeepaliveFramesGetTheirOwnTimestamp(t *testing.T) {
+	w := httptest.NewRecorder()
+	started := keepAliveWhile(w, 10*time.Millisecond, func() []byte { return keepaliveFrame("dall-e-3", false) }, func() {
+		time.Sleep(80 * time.Millisecond)
+	})
+	frames := replyFrames(t, w.Body.String())
+	if !started || len(frames) < 2 {
+		t.Fatalf("got %d keep-alive frames (started %v), want a few", len(frames), started)
+	}
+	for i := 1; i < len(frames); i++ {
+		if frames[i].Done || frames[i].CreatedAt <= frames[i-1].CreatedAt {
+			t.Errorf("frame %d created_at %s doesn't come after %s", i, frames[i].CreatedAt, frames[i-1].CreatedAt)
+		}
+	}
+}
+
+func TestMaxMessagesGuard(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages int
+		status   int
+		calls    int
+	}{
+		{"at the limit", 5, http.StatusOK, 1},
+		{"over the limit", 6, http.StatusRequestEntityTooLarge, 0},
+		{"way over the limit", 20000, http.StatusRequestEntityTooLarge, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newFakeUpstream(t, chatUpstream("ok"))
+			testConfig(t, "-upstream", up.URL, "-max-messages=5")
+			messages := make([]msg, tt.messages)
+			for i := range messages {
+				messages[i] = msg{Role: "user", Content: "hi"}
+			}
+			b, _ := json.Marshal(map[string]interface{}{"model": "gpt-4o", "messages": messages, "stream": false})
+			w := serve(hChat, http.MethodPost, "/api/chat", string(b))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if n := len(up.requests()); n != tt.calls {
+				t.Errorf("upstream got %d requests, want %d", n, tt.calls)
+			}
+			if tt.status != http.StatusOK {
+				var e struct {
+					Error string `json:"error"`
+				}
+				if json.Unmarshal(w.Body.Bytes(), &e) != nil || !strings.HasPrefix(e.Error, "too many messages") {
+					t.Errorf("body %s, want a json error about too many messages", w.Body)
+				}
+			}
+		})
+	}
+}